@@ -5,16 +5,33 @@ package kindi
 import (
 	"appengine"
 	"appengine/datastore"
+	"appengine/delay"
 	"appengine/memcache"
 	"appengine/user"
 
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type KindiAccount struct {
-	KindiCoins int
-	Email      string
+	KindiCoins  int
+	Email       string
+	NoReminders bool
+	// Canonical is Email in canonical form, what lookups match.
+	Canonical string
+	// LookupOrder is how lookups order the account's certificates after
+	// the primary one, see lookupOrders. Empty means newest first.
+	LookupOrder string
+}
+
+// KindiTombstone marks a deleted account, keyed by user ID. Lookups skip
+// certificates processed before Deleted while the cascading delete is
+// still running, and afterwards in case the datastore index lags.
+type KindiTombstone struct {
+	Deleted   time.Time
+	Completed bool
 }
 
 func getAccount(c appengine.Context, userId string) (*KindiAccount, error) {
@@ -43,8 +60,9 @@ func getAccount(c appengine.Context, userId string) (*KindiAccount, error) {
 	return &account, nil
 }
 
-func getOrCreateAccount(c appengine.Context, user *user.User) (*KindiAccount, error) {
+func (s *server) getOrCreateAccount(c appengine.Context, user *user.User) (*KindiAccount, error) {
 	var account KindiAccount
+	canonical := s.canonical(user.Email)
 
 	_, err := memcache.JSON.Get(c, user.ID, &account)
 	if err != nil && err != memcache.ErrCacheMiss {
@@ -54,7 +72,7 @@ func getOrCreateAccount(c appengine.Context, user *user.User) (*KindiAccount, er
 	if err == memcache.ErrCacheMiss {
 		key := datastore.NewKey(c, "KindiAccount", user.ID, 0, nil)
 
-		return &account, datastore.RunInTransaction(c, func(c appengine.Context) error {
+		err = datastore.RunInTransaction(c, func(c appengine.Context) error {
 			err := datastore.Get(c, key, &account)
 			if err != nil && err != datastore.ErrNoSuchEntity {
 				return err
@@ -62,6 +80,7 @@ func getOrCreateAccount(c appengine.Context, user *user.User) (*KindiAccount, er
 
 			if err == datastore.ErrNoSuchEntity {
 				account.Email = user.Email
+				account.Canonical = canonical
 				account.KindiCoins = 0
 				_, err = datastore.Put(c, key, &account)
 				if err != nil {
@@ -75,23 +94,29 @@ func getOrCreateAccount(c appengine.Context, user *user.User) (*KindiAccount, er
 
 			return memcache.JSON.Set(c, memcacheItem)
 		}, nil)
+		if err != nil {
+			return &account, err
+		}
+	}
+
+	if account.Email != user.Email || account.Canonical != canonical {
+		err = s.syncLoginEmail(c, user, &account)
+		if err != nil {
+			return nil, err
+		}
 	}
 	return &account, nil
 }
 
-func coinsHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+func (s *server) coinsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
 	u := user.Current(c)
 	if u == nil {
-		http.Error(w, "no user", http.StatusInternalServerError)
-		return
+		return errNoUser
 	}
 
 	account, err := getAccount(c, u.ID)
 	if err != nil {
-		c.Errorf("error retrieving account: %v", err)
-		http.Error(w, "error retrieving account", http.StatusInternalServerError)
-		return
+		return asKindiError(err, "error retrieving account")
 	}
 
 	var coins int = 0
@@ -102,4 +127,232 @@ func coinsHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	fmt.Fprintf(w, "%d", coins)
+	return nil
+}
+
+// deletedAccounts returns the deletion time of every tombstoned account in
+// userIds.
+func deletedAccounts(c appengine.Context, userIds []string) (map[string]time.Time, error) {
+	r := make(map[string]time.Time)
+	if len(userIds) == 0 {
+		return r, nil
+	}
+
+	keys := make([]*datastore.Key, len(userIds))
+	for i, userId := range userIds {
+		keys[i] = datastore.NewKey(c, "KindiTombstone", userId, 0, nil)
+	}
+
+	tombstones := make([]KindiTombstone, len(keys))
+	err := datastore.GetMulti(c, keys, tombstones)
+	merr, isMulti := err.(appengine.MultiError)
+	if err != nil && !isMulti {
+		return nil, err
+	}
+
+	for i, userId := range userIds {
+		if isMulti && merr[i] != nil {
+			if merr[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return nil, merr[i]
+		}
+		r[userId] = tombstones[i].Deleted
+	}
+	return r, nil
+}
+
+var deleteAccountLater *delay.Function
+
+// accountDataKinds are the kinds stored under a KindiAccount that are
+// simply dropped when the account is deleted, with the property holding
+// when each entity was made and the kind of its children, if any.
+var accountDataKinds = []struct {
+	kind, created, children string
+}{
+	{"KindiInvite", "Sent", ""},
+	{"KindiWatch", "Created", ""},
+	{"KindiExport", "Created", "KindiExportChunk"},
+	{"KindiBulkInvite", "Created", "KindiBulkInviteRow"},
+	{"KindiRenewal", "Renewed", ""},
+	{"KindiEmail", "Added", ""},
+}
+
+// propertyTime is the time stored as name in props.
+func propertyTime(props datastore.PropertyList, name string) time.Time {
+	for _, p := range props {
+		if t, ok := p.Value.(time.Time); ok && p.Name == name {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// deleteKeys deletes keys in batches the datastore accepts.
+func deleteKeys(c appengine.Context, keys []*datastore.Key) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 500 {
+			n = 500
+		}
+		err := datastore.DeleteMulti(c, keys[:n])
+		if err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// deleteAccountData removes everything stored under a deleted account up
+// to the time of deletion. Orders are kept for accounting, moved out from
+// under the account and stripped of the email address.
+func deleteAccountData(c appengine.Context, userId string, deleted time.Time) error {
+	accountKey := datastore.NewKey(c, "KindiAccount", userId, 0, nil)
+
+	certs := make([]KindiCertificate, 0)
+	certKeys, err := datastore.NewQuery("KindiCertificate").Ancestor(accountKey).GetAll(c, &certs)
+	if err != nil {
+		return err
+	}
+	doomed := make([]*datastore.Key, 0, len(certKeys))
+	for i, cert := range certs {
+		if !cert.Processed.After(deleted) {
+			doomed = append(doomed, certKeys[i])
+		}
+	}
+	err = deleteKeys(c, doomed)
+	if err != nil {
+		return err
+	}
+
+	pubKeys := make([]KindiKey, 0)
+	pubKeyKeys, err := datastore.NewQuery("KindiKey").Ancestor(accountKey).GetAll(c, &pubKeys)
+	if err != nil {
+		return err
+	}
+	doomed = doomed[:0]
+	for i, key := range pubKeys {
+		if !key.Processed.After(deleted) {
+			doomed = append(doomed, pubKeyKeys[i])
+		}
+	}
+	err = deleteKeys(c, doomed)
+	if err != nil {
+		return err
+	}
+
+	orders := make([]KindiOrder, 0)
+	orderKeys, err := datastore.NewQuery("KindiOrder").Ancestor(accountKey).GetAll(c, &orders)
+	if err != nil {
+		return err
+	}
+	for i, order := range orders {
+		if order.Processed.After(deleted) {
+			continue
+		}
+		orderKey := orderKeys[i]
+		anonymized := KindiOrder{
+			OrderId:    order.OrderId,
+			Processed:  order.Processed,
+			KindiCoins: order.KindiCoins,
+			Anonymized: true,
+		}
+		err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+			_, err := datastore.Put(c, datastore.NewIncompleteKey(c, "KindiOrder", nil), &anonymized)
+			if err != nil {
+				return err
+			}
+			return datastore.Delete(c, orderKey)
+		}, &datastore.TransactionOptions{XG: true})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Like certificates, data made after the deletion belongs to a new
+	// account of the same user and is kept.
+	for _, data := range accountDataKinds {
+		entities := make([]datastore.PropertyList, 0)
+		keys, err := datastore.NewQuery(data.kind).Ancestor(accountKey).GetAll(c, &entities)
+		if err != nil {
+			return err
+		}
+		doomed = doomed[:0]
+		for i, props := range entities {
+			if propertyTime(props, data.created).After(deleted) {
+				continue
+			}
+			doomed = append(doomed, keys[i])
+			if data.children == "" {
+				continue
+			}
+			children, err := datastore.NewQuery(data.children).Ancestor(keys[i]).KeysOnly().GetAll(c, nil)
+			if err != nil {
+				return err
+			}
+			doomed = append(doomed, children...)
+		}
+		err = deleteKeys(c, doomed)
+		if err != nil {
+			return err
+		}
+	}
+
+	tombstoneKey := datastore.NewKey(c, "KindiTombstone", userId, 0, nil)
+	tombstone := KindiTombstone{
+		Deleted:   deleted,
+		Completed: true,
+	}
+	_, err = datastore.Put(c, tombstoneKey, &tombstone)
+	return err
+}
+
+// deleteAccountHandler closes the account of the current user. The user
+// confirms by sending the account email address. The account itself and
+// its cached copies go right away; the rest is cleaned up in the
+// background.
+func (s *server) deleteAccountHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	account, err := getAccount(c, u.ID)
+	if err != nil {
+		return asKindiError(err, "error retrieving account")
+	}
+
+	confirm := strings.TrimSpace(r.FormValue("confirm"))
+	if !strings.EqualFold(confirm, account.Email) {
+		return badRequest("not_confirmed", "confirm by entering your account email address")
+	}
+
+	now := time.Now()
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	tombstoneKey := datastore.NewKey(c, "KindiTombstone", u.ID, 0, nil)
+
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		_, err := datastore.Put(c, tombstoneKey, &KindiTombstone{Deleted: now})
+		if err != nil {
+			return err
+		}
+		return datastore.Delete(c, accountKey)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return asKindiError(err, "error deleting account")
+	}
+
+	for _, key := range []string{u.ID, u.ID + "-certs"} {
+		err = memcache.Delete(c, key)
+		if err != nil && err != memcache.ErrCacheMiss {
+			c.Errorf("error purging %s from memcache: %v", key, err)
+		}
+	}
+
+	deleteAccountLater.Call(c, u.ID, now)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, "ok")
+	return nil
 }
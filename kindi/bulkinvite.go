@@ -0,0 +1,379 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"appengine/user"
+
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/uwedeportivo/shared/util"
+)
+
+const (
+	bulkInviteMaxRows = 500
+	// Rows sent per task run; the task re-enqueues itself for the rest.
+	bulkInviteBatch = 50
+
+	bulkQueued  = "queued"
+	bulkRunning = "running"
+	bulkDone    = "done"
+
+	rowPending = "pending"
+	rowSent    = "sent"
+	rowSkipped = "skipped"
+	rowFailed  = "failed"
+)
+
+// KindiBulkInvite is a CSV of invites sent in the background. It is a
+// child of the inviter's KindiAccount with one KindiBulkInviteRow child
+// per CSV row.
+type KindiBulkInvite struct {
+	ID        string
+	State     string
+	Created   time.Time
+	Locale    string
+	BaseURL   string `datastore:",noindex"`
+	Total     int
+	Processed int
+	Sent      int
+	Skipped   int
+	Failed    int
+}
+
+type KindiBulkInviteRow struct {
+	Row     int
+	Email   string
+	Note    string `datastore:",noindex"`
+	Status  string
+	Message string `datastore:",noindex"`
+}
+
+type bulkInviteStatus struct {
+	ID        string          `json:"id"`
+	State     string          `json:"state"`
+	Total     int             `json:"total"`
+	Processed int             `json:"processed"`
+	Sent      int             `json:"sent"`
+	Skipped   int             `json:"skipped"`
+	Failed    int             `json:"failed"`
+	Rows      []bulkInviteRow `json:"rows"`
+}
+
+type bulkInviteRow struct {
+	Row     int    `json:"row"`
+	Email   string `json:"email"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+var bulkInviteLater *delay.Function
+
+func bulkInviteKey(c appengine.Context, userId, id string) *datastore.Key {
+	accountKey := datastore.NewKey(c, "KindiAccount", userId, 0, nil)
+	return datastore.NewKey(c, "KindiBulkInvite", id, 0, accountKey)
+}
+
+// parseInviteCSV reads "email[,note]" rows. A first row whose first
+// column is "email" is taken as a header. Rows with invalid addresses, or
+// with the same canonical address as an earlier row, come back already
+// skipped.
+func (s *server) parseInviteCSV(in io.Reader) ([]KindiBulkInviteRow, error) {
+	cr := csv.NewReader(in)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	rows := make([]KindiBulkInviteRow, 0)
+	seen := make(map[string]bool)
+
+	for n := 1; ; n++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) == 0 || strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		if n == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "email") {
+			continue
+		}
+		if len(rows) == bulkInviteMaxRows {
+			return nil, badRequest("too_many_rows", "too many rows in CSV")
+		}
+
+		row := KindiBulkInviteRow{
+			Row:    n,
+			Email:  strings.TrimSpace(record[0]),
+			Status: rowPending,
+		}
+		if len(record) > 1 {
+			row.Note = strings.TrimSpace(record[1])
+		}
+
+		addr, err := mail.ParseAddress(row.Email)
+		var canonical string
+		if err == nil {
+			canonical, err = s.canonicalEmail(addr.Address)
+		}
+		if err != nil {
+			row.Status = rowSkipped
+			row.Message = "invalid address"
+		} else {
+			row.Email = addr.Address
+			if seen[canonical] {
+				row.Status = rowSkipped
+				row.Message = "duplicate"
+			}
+			seen[canonical] = true
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// bulkInviteHandler takes a CSV of recipients, in the "csv" file or form
+// field, and queues an invite for each. One captcha covers the batch.
+func (s *server) bulkInviteHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	var in io.Reader
+	file, _, err := r.FormFile("csv")
+	if err == nil {
+		defer file.Close()
+		in = file
+	} else if text := r.FormValue("csv"); text != "" {
+		in = strings.NewReader(text)
+	} else {
+		return badRequest("no_csv", "no CSV given")
+	}
+
+	human, err := s.captcha.Verify(c, r)
+	if err != nil {
+		return newError(http.StatusServiceUnavailable, "captcha_unavailable", "error verifying captcha", err)
+	}
+	if !human {
+		return errCaptcha
+	}
+
+	rows, err := s.parseInviteCSV(in)
+	if err != nil {
+		return asBadRequest(err, "bad_csv", "error parsing CSV")
+	}
+	if len(rows) == 0 {
+		return badRequest("no_csv", "CSV has no rows")
+	}
+
+	job := KindiBulkInvite{
+		ID:      util.UUID(),
+		State:   bulkQueued,
+		Created: time.Now(),
+		Locale:  s.inviteLocale(r),
+		BaseURL: s.baseURL(r),
+		Total:   len(rows),
+	}
+	key := bulkInviteKey(c, u.ID, job.ID)
+
+	rowKeys := make([]*datastore.Key, len(rows))
+	for i := range rows {
+		rowKeys[i] = datastore.NewKey(c, "KindiBulkInviteRow", "", int64(i+1), key)
+	}
+	job.count(rows)
+
+	_, err = datastore.Put(c, key, &job)
+	if err != nil {
+		return internalError("error saving bulk invite", err)
+	}
+	_, err = datastore.PutMulti(c, rowKeys, rows)
+	if err != nil {
+		return internalError("error saving bulk invite", err)
+	}
+
+	bulkInviteLater.Call(c, u.ID, u.Email, job.ID)
+
+	return writeBulkInviteStatus(c, w, http.StatusAccepted, key, &job)
+}
+
+// count sets the job's counters from its rows.
+func (job *KindiBulkInvite) count(rows []KindiBulkInviteRow) {
+	job.Processed, job.Sent, job.Skipped, job.Failed = 0, 0, 0, 0
+	for _, row := range rows {
+		switch row.Status {
+		case rowSent:
+			job.Sent++
+		case rowSkipped:
+			job.Skipped++
+		case rowFailed:
+			job.Failed++
+		default:
+			continue
+		}
+		job.Processed++
+	}
+}
+
+func asBadRequest(err error, code, message string) error {
+	if ke, ok := err.(*kindiError); ok {
+		return ke
+	}
+	return newError(http.StatusBadRequest, code, message, err)
+}
+
+// processBulkInvite sends the next batch of pending rows and re-enqueues
+// itself until none are left.
+func (s *server) processBulkInvite(c appengine.Context, userId, inviterEmail, id string) error {
+	key := bulkInviteKey(c, userId, id)
+
+	var job KindiBulkInvite
+	err := datastore.Get(c, key, &job)
+	if err != nil {
+		return err
+	}
+	if job.State == bulkDone {
+		return nil
+	}
+
+	rows := make([]KindiBulkInviteRow, 0)
+	q := datastore.NewQuery("KindiBulkInviteRow").Ancestor(key).Filter("Status=", rowPending).Limit(bulkInviteBatch)
+	rowKeys, err := q.GetAll(c, &rows)
+	if err != nil {
+		return err
+	}
+
+	inviter := &user.User{ID: userId, Email: inviterEmail}
+
+	for i := range rows {
+		row := &rows[i]
+
+		published, err := hasValidCertificate(c, s.canonical(row.Email))
+		if err != nil {
+			return err
+		}
+		if published {
+			row.Status = rowSkipped
+			row.Message = "already has a certificate"
+		} else {
+			err = s.sendInvite(c, inviter, row.Email, row.Note, job.Locale, job.BaseURL)
+			if err == nil {
+				row.Status = rowSent
+			} else if ke := asKindiError(err, ""); ke.Status < http.StatusInternalServerError {
+				row.Status = rowSkipped
+				row.Message = ke.Message
+			} else {
+				c.Errorf("error sending bulk invite to %s: %v", row.Email, err)
+				row.Status = rowFailed
+				row.Message = "error sending invite"
+			}
+		}
+
+		// Saving each row as it is done keeps a retried task from
+		// inviting anybody twice.
+		_, err = datastore.Put(c, rowKeys[i], row)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The counters are recounted from the saved rows rather than added
+	// to, so that a task retried after saving some of its rows does not
+	// count them twice.
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		err := datastore.Get(c, key, &job)
+		if err != nil {
+			return err
+		}
+		all := make([]KindiBulkInviteRow, 0, job.Total)
+		_, err = datastore.NewQuery("KindiBulkInviteRow").Ancestor(key).GetAll(c, &all)
+		if err != nil {
+			return err
+		}
+		job.count(all)
+		job.State = bulkRunning
+		if job.Processed >= job.Total {
+			job.State = bulkDone
+		}
+		_, err = datastore.Put(c, key, &job)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	if job.State != bulkDone {
+		bulkInviteLater.Call(c, userId, inviterEmail, id)
+	}
+	return nil
+}
+
+func writeBulkInviteStatus(c appengine.Context, w http.ResponseWriter, code int, key *datastore.Key, job *KindiBulkInvite) error {
+	rows := make([]KindiBulkInviteRow, 0)
+	_, err := datastore.NewQuery("KindiBulkInviteRow").Ancestor(key).GetAll(c, &rows)
+	if err != nil {
+		return internalError("error reading bulk invite", err)
+	}
+
+	status := bulkInviteStatus{
+		ID:        job.ID,
+		State:     job.State,
+		Total:     job.Total,
+		Processed: job.Processed,
+		Sent:      job.Sent,
+		Skipped:   job.Skipped,
+		Failed:    job.Failed,
+		Rows:      make([]bulkInviteRow, len(rows)),
+	}
+	for i, row := range rows {
+		status.Rows[i] = bulkInviteRow{
+			Row:     row.Row,
+			Email:   row.Email,
+			Status:  row.Status,
+			Message: row.Message,
+		}
+	}
+
+	body, err := json.Marshal(status)
+	if err != nil {
+		return internalError("error marshalling bulk invite", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+	return nil
+}
+
+func (s *server) bulkInviteStatusHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		return badRequest("no_bulk_invite", "no bulk invite id given")
+	}
+
+	key := bulkInviteKey(c, u.ID, id)
+	var job KindiBulkInvite
+	err := datastore.Get(c, key, &job)
+	if err == datastore.ErrNoSuchEntity {
+		return notFound("no_bulk_invite", "no such bulk invite")
+	}
+	if err != nil {
+		return internalError("error reading bulk invite", err)
+	}
+	return writeBulkInviteStatus(c, w, http.StatusOK, key, &job)
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseInviteCSV(t *testing.T) {
+	plain := &server{config: &Config{}}
+	rules := &server{config: &Config{Emails: EmailsConfig{
+		FoldCase:   []string{"gmail.com"},
+		StripTags:  []string{"gmail.com"},
+		IgnoreDots: []string{"gmail.com"},
+	}}}
+
+	tests := []struct {
+		name string
+		s    *server
+		csv  string
+		want []KindiBulkInviteRow
+	}{
+		{"empty", plain, "", []KindiBulkInviteRow{}},
+		{"addresses", plain, "alice@example.com\nbob@example.com\n", []KindiBulkInviteRow{
+			{Row: 1, Email: "alice@example.com", Status: rowPending},
+			{Row: 2, Email: "bob@example.com", Status: rowPending},
+		}},
+		{"header and notes", plain, "Email,Note\nalice@example.com, from the meetup \nbob@example.com\n", []KindiBulkInviteRow{
+			{Row: 2, Email: "alice@example.com", Note: "from the meetup", Status: rowPending},
+			{Row: 3, Email: "bob@example.com", Status: rowPending},
+		}},
+		{"header only in the first row", plain, "alice@example.com\nemail\n", []KindiBulkInviteRow{
+			{Row: 1, Email: "alice@example.com", Status: rowPending},
+			{Row: 2, Email: "email", Status: rowSkipped, Message: "invalid address"},
+		}},
+		{"display names and space", plain, "  Alice <alice@example.com>\r\n\r\n,no address\r\n", []KindiBulkInviteRow{
+			{Row: 1, Email: "alice@example.com", Status: rowPending},
+		}},
+		{"quoted note", plain, "alice@example.com,\"hi, Alice\"\n", []KindiBulkInviteRow{
+			{Row: 1, Email: "alice@example.com", Note: "hi, Alice", Status: rowPending},
+		}},
+		{"invalid and duplicate", plain, "not an address\nalice@example.com\nalice@EXAMPLE.com\nALICE@example.com\n", []KindiBulkInviteRow{
+			{Row: 1, Email: "not an address", Status: rowSkipped, Message: "invalid address"},
+			{Row: 2, Email: "alice@example.com", Status: rowPending},
+			{Row: 3, Email: "alice@EXAMPLE.com", Status: rowSkipped, Message: "duplicate"},
+			{Row: 4, Email: "ALICE@example.com", Status: rowPending},
+		}},
+		{"duplicate by the domain's rules", rules, "alice@gmail.com\nA.Lice+news@gmail.com\na.lice@example.com\n", []KindiBulkInviteRow{
+			{Row: 1, Email: "alice@gmail.com", Status: rowPending},
+			{Row: 2, Email: "A.Lice+news@gmail.com", Status: rowSkipped, Message: "duplicate"},
+			{Row: 3, Email: "a.lice@example.com", Status: rowPending},
+		}},
+		{"only a tag", rules, "+news@gmail.com\n", []KindiBulkInviteRow{
+			{Row: 1, Email: "+news@gmail.com", Status: rowSkipped, Message: "invalid address"},
+		}},
+	}
+	for _, tt := range tests {
+		got, err := tt.s.parseInviteCSV(strings.NewReader(tt.csv))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseInviteCSVErrors(t *testing.T) {
+	s := &server{config: &Config{}}
+	tooMany := new(strings.Builder)
+	for i := 0; i <= bulkInviteMaxRows; i++ {
+		fmt.Fprintf(tooMany, "user%d@example.com\n", i)
+	}
+
+	tests := []struct {
+		name string
+		csv  string
+	}{
+		{"bad quoting", "\"alice@example.com\n"},
+		{"too many rows", tooMany.String()},
+	}
+	for _, tt := range tests {
+		if rows, err := s.parseInviteCSV(strings.NewReader(tt.csv)); err == nil {
+			t.Errorf("%s: got %d rows, want an error", tt.name, len(rows))
+		}
+	}
+}
+
+func TestBulkInviteCount(t *testing.T) {
+	rows := func(statuses ...string) []KindiBulkInviteRow {
+		r := make([]KindiBulkInviteRow, len(statuses))
+		for i, status := range statuses {
+			r[i] = KindiBulkInviteRow{Row: i + 1, Status: status}
+		}
+		return r
+	}
+
+	tests := []struct {
+		name string
+		rows []KindiBulkInviteRow
+		want KindiBulkInvite
+	}{
+		{"none", nil, KindiBulkInvite{}},
+		{"all pending", rows(rowPending, rowPending), KindiBulkInvite{}},
+		{"mixed", rows(rowSent, rowPending, rowSkipped, rowFailed, rowSent), KindiBulkInvite{Processed: 4, Sent: 2, Skipped: 1, Failed: 1}},
+	}
+	for _, tt := range tests {
+		// Counters from an earlier run are replaced, not added to.
+		got := KindiBulkInvite{Processed: 9, Sent: 9, Skipped: 9, Failed: 9}
+		got.count(tt.rows)
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Issued certificates are valid from a little before they are issued, for
+// clients whose clocks run late.
+const caBackdate = 5 * time.Minute
+
+var errCADisabled = newError(http.StatusNotFound, "ca_disabled", "kindi does not issue certificates", nil)
+
+// CASigner holds the key of the intermediate CA that kindi issues
+// certificates from. The key itself need not be reachable: Sign works
+// like crypto.Signer, handing out only signatures.
+type CASigner interface {
+	// Certificate is the CA certificate issued certificates chain to.
+	Certificate() *x509.Certificate
+	Sign(c appengine.Context, digest []byte, opts crypto.SignerOpts) ([]byte, error)
+}
+
+// newCASigner returns nil when issuing is turned off.
+func newCASigner(cfg CAConfig, secrets SecretProvider) (CASigner, error) {
+	if cfg.Signer == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(cfg.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("ca certificate: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("ca certificate %s: no CERTIFICATE block", cfg.Certificate)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("ca certificate %s: %v", cfg.Certificate, err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("ca certificate %s is not a CA certificate", cfg.Certificate)
+	}
+
+	if cfg.Signer == "kms" {
+		return &kmsSigner{cert: cert, keyName: cfg.KeyName, secrets: secrets}, nil
+	}
+
+	data, err = ioutil.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("ca key: %v", err)
+	}
+	key, err := parsePrivateKeyPEM(data, cert)
+	if err != nil {
+		return nil, fmt.Errorf("ca key %s: %v", cfg.KeyFile, err)
+	}
+	return &fileSigner{cert: cert, key: key}, nil
+}
+
+// parsePrivateKeyPEM reads a PKCS #8, PKCS #1 or SEC 1 private key and
+// checks that it belongs to cert.
+func parsePrivateKeyPEM(data []byte, cert *x509.Certificate) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("key cannot sign")
+	}
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return nil, errors.New("key does not belong to the CA certificate")
+	}
+	return signer, nil
+}
+
+// fileSigner keeps the CA key in memory, read from a file. Meant for the
+// dev server.
+type fileSigner struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func (s *fileSigner) Certificate() *x509.Certificate {
+	return s.cert
+}
+
+func (s *fileSigner) Sign(c appengine.Context, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.key.Sign(rand.Reader, digest, opts)
+}
+
+// kmsSigner stands in for an HSM or a cloud KMS: the key lives in the
+// secret store under keyName and is only used to sign, never handed out.
+// Swapping in a real KMS means replacing Sign with a call to it.
+type kmsSigner struct {
+	cert    *x509.Certificate
+	keyName string
+	secrets SecretProvider
+
+	mu  sync.Mutex
+	key crypto.Signer
+}
+
+func (s *kmsSigner) Certificate() *x509.Certificate {
+	return s.cert
+}
+
+func (s *kmsSigner) Sign(c appengine.Context, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.key == nil {
+		secret, err := s.secrets.Secret(c, s.keyName)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parsePrivateKeyPEM([]byte(secret), s.cert)
+		if err != nil {
+			return nil, fmt.Errorf("ca key %s: %v", s.keyName, err)
+		}
+		s.key = key
+	}
+	return s.key.Sign(rand.Reader, digest, opts)
+}
+
+// boundSigner adapts a CASigner to the crypto.Signer x509 wants, for the
+// duration of one request.
+type boundSigner struct {
+	c  appengine.Context
+	ca CASigner
+}
+
+func (b boundSigner) Public() crypto.PublicKey {
+	return b.ca.Certificate().PublicKey
+}
+
+func (b boundSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return b.ca.Sign(b.c, digest, opts)
+}
+
+// csrEmails are the email addresses a CSR asks for, from its alternative
+// names and its subject.
+func csrEmails(csr *x509.CertificateRequest) []string {
+	r := append(make([]string, 0), csr.EmailAddresses...)
+	for _, atv := range csr.Subject.Names {
+		if atv.Type.Equal(oidEmailAddress) {
+			if email, ok := atv.Value.(string); ok {
+				r = append(r, email)
+			}
+		}
+	}
+	return r
+}
+
+// issueCertificate signs a short-lived encryption certificate for email
+// with the key of csr.
+func (s *server) issueCertificate(c appengine.Context, csr *x509.CertificateRequest, email string) ([]byte, error) {
+	var usage x509.KeyUsage
+	switch csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		usage = x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	case *ecdsa.PublicKey:
+		usage = x509.KeyUsageKeyAgreement | x509.KeyUsageDigitalSignature
+	default:
+		return nil, badRequest("unsupported_key", "only RSA and ECDSA keys can be certified")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: email},
+		EmailAddresses:        []string{email},
+		NotBefore:             now.Add(-caBackdate),
+		NotAfter:              now.Add(s.config.CA.Validity.Duration),
+		KeyUsage:              usage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+		BasicConstraintsValid: true,
+	}
+	ca := s.ca.Certificate()
+	return x509.CreateCertificate(rand.Reader, template, ca, csr.PublicKey, boundSigner{c, s.ca})
+}
+
+type issuedCertificate struct {
+	ID string `json:"id"`
+	// Certificate and Chain are PEM: the issued certificate and it
+	// followed by the CA certificate.
+	Certificate string `json:"certificate"`
+	Chain       string `json:"chain"`
+}
+
+// issueHandler certifies the key of a PEM CSR given as csr for one of
+// the user's verified addresses, publishes the certificate like an upload
+// and charges for it the same way.
+func (s *server) issueHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	if s.ca == nil {
+		return errCADisabled
+	}
+
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	csrStr := r.FormValue("csr")
+	if csrStr == "" {
+		return badRequest("no_csr", "no certificate request")
+	}
+
+	block, _ := pem.Decode([]byte(csrStr))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST" {
+		return badRequest("invalid_pem", "no PEM block found, paste the text starting with -----BEGIN CERTIFICATE REQUEST-----")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return badRequest("invalid_csr", "certificate request cannot be parsed: "+err.Error())
+	}
+	err = csr.CheckSignature()
+	if err != nil {
+		return badRequest("invalid_csr", "certificate request is not signed by its key")
+	}
+
+	emails := csrEmails(csr)
+	if len(emails) == 0 {
+		return badRequest("no_email", "certificate request names no email address")
+	}
+	addresses, err := s.accountAddresses(c, u)
+	if err != nil {
+		return internalError("error reading addresses", err)
+	}
+	for _, email := range emails {
+		if s.canonical(email) != s.canonical(emails[0]) {
+			return badRequest("several_emails", "certificate request names more than one email address")
+		}
+		if !hasAddress(addresses, s.canonical(email)) {
+			return newError(http.StatusForbidden, "email_mismatch", fmt.Sprintf("%s is not a verified address of your account", email), nil)
+		}
+	}
+
+	// Check for coins before signing; storeCertificate charges them.
+	account, err := getAccount(c, u.ID)
+	if err != nil {
+		return asKindiError(err, "error retrieving account")
+	}
+	if account.KindiCoins <= 0 {
+		return errNoCoins
+	}
+
+	der, err := s.issueCertificate(c, csr, emails[0])
+	if err != nil {
+		return asKindiError(err, "error issuing certificate")
+	}
+
+	cert, err := s.storeCertificate(c, u, r.FormValue("name"), der, r.FormValue("renew"))
+	if err != nil {
+		return err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.ca.Certificate().Raw})
+	body, err := json.Marshal(issuedCertificate{
+		ID:          cert.ID,
+		Certificate: string(certPEM),
+		Chain:       string(certPEM) + string(caPEM),
+	})
+	if err != nil {
+		return internalError("error marshalling certificate", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+	return nil
+}
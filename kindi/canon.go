@@ -0,0 +1,446 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/uwedeportivo/shared/util"
+	"golang.org/x/net/idna"
+)
+
+// canonicalEmail is the form of address that is stored and looked up: no
+// surrounding space or display name, the domain mapped by IDNA, which
+// lower cases it, and the rules of emails.foldCase, emails.stripTags and
+// emails.ignoreDots applied. The local part keeps its case unless the
+// domain is in emails.foldCase, as RFC 5321 leaves that to the mailbox.
+func (s *server) canonicalEmail(address string) (string, error) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(address))
+	if err != nil {
+		return "", err
+	}
+	at := strings.LastIndex(addr.Address, "@")
+	local := addr.Address[:at]
+	domain, err := asciiDomain(addr.Address[at+1:])
+	if err != nil {
+		return "", err
+	}
+
+	if hasDomain(s.config.Emails.FoldCase, domain) {
+		local = strings.ToLower(local)
+	}
+	if hasDomain(s.config.Emails.StripTags, domain) {
+		if i := strings.Index(local, "+"); i >= 0 {
+			local = local[:i]
+		}
+	}
+	if hasDomain(s.config.Emails.IgnoreDots, domain) {
+		local = strings.Replace(local, ".", "", -1)
+	}
+	if local == "" {
+		return "", errors.New("address is only a tag")
+	}
+	return local + "@" + domain, nil
+}
+
+// canonical is canonicalEmail for addresses accepted before, like login
+// emails and stored ones. Those it cannot parse are only trimmed.
+func (s *server) canonical(address string) string {
+	r, err := s.canonicalEmail(address)
+	if err != nil {
+		return strings.TrimSpace(address)
+	}
+	return r
+}
+
+// certAddresses are the canonical email addresses in cert's subject
+// alternative names.
+func (s *server) certAddresses(cert *x509.Certificate) []string {
+	return s.canonicalList(cert.EmailAddresses)
+}
+
+func hasDomain(domains []string, domain string) bool {
+	for _, d := range domains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// asciiDomain maps domain with the IDNA lookup profile of UTS #46, which
+// lower cases and normalizes it and converts internationalized labels to
+// punycode.
+func asciiDomain(domain string) (string, error) {
+	domain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", err
+	}
+	domain = strings.TrimSuffix(domain, ".")
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return "", fmt.Errorf("bad domain %q", domain)
+		}
+	}
+	if len(domain) > 253 {
+		return "", errors.New("domain is too long")
+	}
+	return domain, nil
+}
+
+// Stored addresses are canonicalized in batches of this size.
+const canonicalizeBatch = 200
+
+// canonicalizeKinds are the kinds canonicalizeEmails goes through, in
+// order.
+var canonicalizeKinds = []string{"KindiCertificate", "KindiKey", "KindiWatch", "KindiInvite", "KindiSuppression", "KindiEmail", "KindiAccount"}
+
+// canonicalRulesVersion is raised whenever canonicalEmail changes, so
+// that canonicalize-emails goes over the stored addresses again.
+const canonicalRulesVersion = 2
+
+// A canonicalize-emails run that has not finished a batch for this long
+// is taken to have died, and the next cron call starts over.
+const canonicalizeStale = time.Hour
+
+// KindiCanonicalization records the last canonicalize-emails run: the
+// rules it ran for, its ID and whether it finished. There is one, keyed
+// "emails".
+type KindiCanonicalization struct {
+	Rules   string
+	Run     string
+	Done    bool
+	Updated time.Time
+}
+
+// canonicalRules identifies the rules canonicalEmail applies.
+func (s *server) canonicalRules() string {
+	return fmt.Sprintf("v%d foldCase=%s stripTags=%s ignoreDots=%s", canonicalRulesVersion,
+		strings.Join(s.config.Emails.FoldCase, ","), strings.Join(s.config.Emails.StripTags, ","),
+		strings.Join(s.config.Emails.IgnoreDots, ","))
+}
+
+// canonicalizeEmails brings the addresses stored before canonicalization,
+// or before the rules last changed, into canonical form. It works through
+// canonicalizeKinds one batch at a time, continuing in a new job with the
+// kind and the query cursor it got to. Cron starts it daily, but it only
+// runs when the rules changed since the last run finished.
+func (s *server) canonicalizeEmails(c appengine.Context, params url.Values) error {
+	stateKey := datastore.NewKey(c, "KindiCanonicalization", "emails", 0, nil)
+	var state KindiCanonicalization
+	err := datastore.Get(c, stateKey, &state)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	rules := s.canonicalRules()
+	kind := params.Get("kind")
+	if kind == "" {
+		if state.Rules == rules && (state.Done || time.Since(state.Updated) < canonicalizeStale) {
+			return nil
+		}
+		state = KindiCanonicalization{Rules: rules, Run: util.UUID()}
+		kind = canonicalizeKinds[0]
+	} else if state.Run != params.Get("run") {
+		c.Infof("canonicalize-emails run %s was replaced by %s", params.Get("run"), state.Run)
+		return nil
+	}
+	state.Updated = time.Now()
+	_, err = datastore.Put(c, stateKey, &state)
+	if err != nil {
+		return err
+	}
+
+	q := datastore.NewQuery(kind).Limit(canonicalizeBatch)
+	if cursor := params.Get("cursor"); cursor != "" {
+		start, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return err
+		}
+		q = q.Start(start)
+	}
+
+	keys := make([]*datastore.Key, 0, canonicalizeBatch)
+	it := q.KeysOnly().Run(c)
+	for {
+		key, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	changed := 0
+	for _, key := range keys {
+		var err error
+		var ok bool
+		switch kind {
+		case "KindiCertificate":
+			ok, err = s.canonicalizeCertificate(c, key)
+		case "KindiKey":
+			ok, err = s.canonicalizeKey(c, key)
+		case "KindiWatch":
+			ok, err = s.canonicalizeWatch(c, key)
+		case "KindiInvite":
+			ok, err = s.canonicalizeInvite(c, key)
+		case "KindiSuppression":
+			ok, err = s.canonicalizeSuppression(c, key)
+		case "KindiEmail":
+			ok, err = s.canonicalizeAddress(c, key)
+		case "KindiAccount":
+			ok, err = s.canonicalizeAccount(c, key)
+		default:
+			return fmt.Errorf("cannot canonicalize %s", kind)
+		}
+		if err != nil {
+			return err
+		}
+		if ok {
+			changed++
+		}
+	}
+	c.Infof("canonicalized %d of %d %s addresses", changed, len(keys), kind)
+
+	next := url.Values{"run": {state.Run}, "kind": {kind}}
+	if len(keys) == canonicalizeBatch {
+		cursor, err := it.Cursor()
+		if err != nil {
+			return err
+		}
+		next.Set("cursor", cursor.String())
+	} else {
+		i := 0
+		for i < len(canonicalizeKinds) && canonicalizeKinds[i] != kind {
+			i++
+		}
+		if i+1 >= len(canonicalizeKinds) {
+			state.Done = true
+			_, err := datastore.Put(c, stateKey, &state)
+			return err
+		}
+		next.Set("kind", canonicalizeKinds[i+1])
+	}
+	return s.enqueueJob(c, "canonicalize-emails", "", next, 0)
+}
+
+// forgetCertificates drops the cached certificates of the owner of key.
+func forgetCertificates(c appengine.Context, key *datastore.Key) error {
+	if parent := key.Parent(); parent != nil {
+		err := memcache.Delete(c, parent.StringID()+"-certs")
+		if err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *server) canonicalizeCertificate(c appengine.Context, key *datastore.Key) (bool, error) {
+	changed := false
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var cert KindiCertificate
+		err := datastore.Get(c, key, &cert)
+		if err != nil {
+			return err
+		}
+		email := s.canonical(cert.Email)
+		addresses := s.canonicalList(cert.Addresses)
+		changed = email != cert.Email || strings.Join(addresses, ",") != strings.Join(cert.Addresses, ",")
+		if !changed {
+			return nil
+		}
+		cert.Email = email
+		cert.Addresses = addresses
+		_, err = datastore.Put(c, key, &cert)
+		if err != nil {
+			return err
+		}
+		return forgetCertificates(c, key)
+	}, nil)
+	return changed, err
+}
+
+// canonicalList returns the canonical forms of addresses, each once.
+func (s *server) canonicalList(addresses []string) []string {
+	r := make([]string, 0, len(addresses))
+	for _, a := range addresses {
+		if a = s.canonical(a); !hasAddress(r, a) {
+			r = append(r, a)
+		}
+	}
+	return r
+}
+
+// canonicalizeKey also signs a new description for the key, as the old
+// one names the addresses it had.
+func (s *server) canonicalizeKey(c appengine.Context, key *datastore.Key) (bool, error) {
+	priv, err := s.issuerKey(c)
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var pubKey KindiKey
+		err := datastore.Get(c, key, &pubKey)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		email := s.canonical(pubKey.Email)
+		addresses := s.canonicalList(pubKey.Addresses)
+		changed = email != pubKey.Email || strings.Join(addresses, ",") != strings.Join(pubKey.Addresses, ",")
+		if !changed {
+			return nil
+		}
+		pubKey.Email = email
+		pubKey.Addresses = addresses
+		err = s.describeKeyWith(c, priv, &pubKey)
+		if err != nil {
+			return err
+		}
+		_, err = datastore.Put(c, key, &pubKey)
+		return err
+	}, nil)
+	return changed, err
+}
+
+func (s *server) canonicalizeWatch(c appengine.Context, key *datastore.Key) (bool, error) {
+	changed := false
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var watch KindiWatch
+		err := datastore.Get(c, key, &watch)
+		if err != nil {
+			return err
+		}
+		email := s.canonical(watch.Email)
+		if changed = email != watch.Email; !changed {
+			return nil
+		}
+		watch.Email = email
+		_, err = datastore.Put(c, key, &watch)
+		return err
+	}, nil)
+	return changed, err
+}
+
+func (s *server) canonicalizeInvite(c appengine.Context, key *datastore.Key) (bool, error) {
+	changed := false
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var invite KindiInvite
+		err := datastore.Get(c, key, &invite)
+		if err != nil {
+			return err
+		}
+		recipient := s.canonical(invite.Recipient)
+		if changed = recipient != invite.Recipient; !changed {
+			return nil
+		}
+		invite.Recipient = recipient
+		_, err = datastore.Put(c, key, &invite)
+		return err
+	}, nil)
+	return changed, err
+}
+
+// canonicalizeSuppression moves a KindiSuppression to the key of its
+// canonical address.
+func (s *server) canonicalizeSuppression(c appengine.Context, key *datastore.Key) (bool, error) {
+	address := s.canonical(key.StringID())
+	if address == key.StringID() {
+		return false, nil
+	}
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var suppression KindiSuppression
+		err := datastore.Get(c, key, &suppression)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		suppression.Email = address
+		_, err = datastore.Put(c, suppressionKey(c, address), &suppression)
+		if err != nil {
+			return err
+		}
+		return datastore.Delete(c, key)
+	}, &datastore.TransactionOptions{XG: true})
+	return err == nil, err
+}
+
+// canonicalizeAddress moves a KindiEmail to the key of its canonical
+// address. If the account already has that one, the two are merged.
+func (s *server) canonicalizeAddress(c appengine.Context, key *datastore.Key) (bool, error) {
+	changed := false
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var email KindiEmail
+		err := datastore.Get(c, key, &email)
+		if err != nil {
+			return err
+		}
+		address := s.canonical(email.Address)
+		if changed = address != email.Address || address != key.StringID(); !changed {
+			return nil
+		}
+
+		newKey := emailKey(c, key.Parent().StringID(), address)
+		if !newKey.Equal(key) {
+			var existing KindiEmail
+			err = datastore.Get(c, newKey, &existing)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			if err == nil && (existing.Verified || !email.Verified) {
+				return datastore.Delete(c, key)
+			}
+			err = datastore.Delete(c, key)
+			if err != nil {
+				return err
+			}
+		}
+		email.Address = address
+		_, err = datastore.Put(c, newKey, &email)
+		return err
+	}, nil)
+	return changed, err
+}
+
+func (s *server) canonicalizeAccount(c appengine.Context, key *datastore.Key) (bool, error) {
+	changed := false
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var account KindiAccount
+		err := datastore.Get(c, key, &account)
+		if err != nil {
+			return err
+		}
+		canonical := s.canonical(account.Email)
+		if changed = canonical != account.Canonical; !changed {
+			return nil
+		}
+		account.Canonical = canonical
+		_, err = datastore.Put(c, key, &account)
+		if err != nil {
+			return err
+		}
+		return memcache.JSON.Set(c, &memcache.Item{
+			Key:    key.StringID(),
+			Object: account,
+		})
+	}, nil)
+	return changed, err
+}
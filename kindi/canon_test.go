@@ -0,0 +1,88 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCanonicalEmail(t *testing.T) {
+	plain := &server{config: &Config{}}
+	rules := &server{config: &Config{Emails: EmailsConfig{
+		FoldCase:   []string{"gmail.com"},
+		StripTags:  []string{"example.com", "gmail.com"},
+		IgnoreDots: []string{"gmail.com"},
+	}}}
+
+	tests := []struct {
+		s       *server
+		address string
+		want    string
+	}{
+		{plain, "alice@example.com", "alice@example.com"},
+		{plain, " Alice@Example.com", "Alice@example.com"},
+		{plain, "ALICE@EXAMPLE.COM\t", "ALICE@example.com"},
+		{plain, "Alice Liddell <Alice@Example.com>", "Alice@example.com"},
+		{plain, "Alice@GMail.com", "Alice@gmail.com"},
+		{plain, "alice+tag@example.com", "alice+tag@example.com"},
+		{plain, "a.lice@gmail.com", "a.lice@gmail.com"},
+		{rules, " Alice@Example.com", "Alice@example.com"},
+		{rules, " Alice@GMail.com", "alice@gmail.com"},
+		{rules, "alice+tag@example.com", "alice@example.com"},
+		{rules, "alice+tag+more@example.com", "alice@example.com"},
+		{rules, "alice+tag@example.org", "alice+tag@example.org"},
+		{rules, "A.Lice+news@GMail.com", "alice@gmail.com"},
+		{rules, "a.lice@example.com", "a.lice@example.com"},
+		// Composed and decomposed ü are the same domain.
+		{plain, "alice@B\u00fccher.example", "alice@xn--bcher-kva.example"},
+		{plain, "alice@Bu\u0308cher.example", "alice@xn--bcher-kva.example"},
+		{plain, "alice@xn--bcher-kva.example", "alice@xn--bcher-kva.example"},
+		{plain, "alice@例え。テスト", "alice@xn--r8jz45g.xn--zckzah"},
+		{plain, "alice@ｅｘａｍｐｌｅ.com", "alice@example.com"},
+	}
+	for _, tt := range tests {
+		got, err := tt.s.canonicalEmail(tt.address)
+		if err != nil {
+			t.Errorf("canonicalEmail(%q): %v", tt.address, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("canonicalEmail(%q) = %q, want %q", tt.address, got, tt.want)
+		}
+	}
+
+	bad := []struct {
+		s       *server
+		address string
+	}{
+		{plain, ""},
+		{plain, "alice"},
+		{plain, "alice@"},
+		{plain, "alice@example..com"},
+		{plain, "alice@" + strings.Repeat("a", 64) + ".com"},
+		{rules, "+tag@example.com"},
+	}
+	for _, tt := range bad {
+		if got, err := tt.s.canonicalEmail(tt.address); err == nil {
+			t.Errorf("canonicalEmail(%q) = %q, want an error", tt.address, got)
+		}
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	s := &server{config: &Config{}}
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{" Alice@Example.com", "Alice@example.com"},
+		// Stored addresses that do not parse are only trimmed.
+		{" Not An Address ", "Not An Address"},
+	}
+	for _, tt := range tests {
+		if got := s.canonical(tt.address); got != tt.want {
+			t.Errorf("canonical(%q) = %q, want %q", tt.address, got, tt.want)
+		}
+	}
+}
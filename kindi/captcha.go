@@ -0,0 +1,137 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/urlfetch"
+
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// CaptchaVerifier decides whether the request was submitted by a human.
+// A false result means the captcha was answered wrong; an error means the
+// answer could not be checked.
+type CaptchaVerifier interface {
+	Verify(c appengine.Context, r *http.Request) (bool, error)
+}
+
+// siteVerifyProvider describes a captcha service speaking the siteverify
+// protocol shared by reCAPTCHA, hCaptcha and Turnstile.
+type siteVerifyProvider struct {
+	url           string
+	responseField string
+	scored        bool
+}
+
+var siteVerifyProviders = map[string]siteVerifyProvider{
+	"recaptcha-v2": {"https://www.google.com/recaptcha/api/siteverify", "g-recaptcha-response", false},
+	"recaptcha-v3": {"https://www.google.com/recaptcha/api/siteverify", "g-recaptcha-response", true},
+	"hcaptcha":     {"https://hcaptcha.com/siteverify", "h-captcha-response", false},
+	"turnstile":    {"https://challenges.cloudflare.com/turnstile/v0/siteverify", "cf-turnstile-response", false},
+}
+
+func newCaptchaVerifier(cfg CaptchaConfig, secrets SecretProvider) CaptchaVerifier {
+	switch cfg.Provider {
+	case "always-pass":
+		return staticCaptchaVerifier(true)
+	case "always-fail":
+		return staticCaptchaVerifier(false)
+	}
+
+	provider := siteVerifyProviders[cfg.Provider]
+	if cfg.URL != "" {
+		provider.url = cfg.URL
+	}
+	return &siteVerifyVerifier{
+		provider: provider,
+		secrets:  secrets,
+		keyName:  cfg.PrivateKeyName,
+		minScore: cfg.MinScore,
+		action:   cfg.Action,
+		timeout:  cfg.Timeout.Duration,
+	}
+}
+
+type siteVerifyResponse struct {
+	Success    bool     `json:"success"`
+	Score      float64  `json:"score"`
+	Action     string   `json:"action"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+type siteVerifyVerifier struct {
+	provider siteVerifyProvider
+	secrets  SecretProvider
+	keyName  string
+	minScore float64
+	action   string
+	timeout  time.Duration
+}
+
+func (v *siteVerifyVerifier) Verify(c appengine.Context, r *http.Request) (bool, error) {
+	answer := r.FormValue(v.provider.responseField)
+	if answer == "" {
+		return false, nil
+	}
+
+	secret, err := v.secrets.Secret(c, v.keyName)
+	if err != nil {
+		return false, err
+	}
+
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("response", answer)
+	values.Set("remoteip", r.RemoteAddr)
+
+	client := &http.Client{
+		Transport: &urlfetch.Transport{
+			Context:  c,
+			Deadline: v.timeout,
+		},
+	}
+	resp, err := client.PostForm(v.provider.url, values)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("captcha verification returned %s", resp.Status)
+	}
+
+	var result siteVerifyResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return false, fmt.Errorf("error decoding captcha verification: %v", err)
+	}
+
+	if !result.Success {
+		c.Infof("captcha rejected: %v", result.ErrorCodes)
+		return false, nil
+	}
+	if v.provider.scored {
+		if result.Score < v.minScore {
+			c.Infof("captcha score %.2f below %.2f", result.Score, v.minScore)
+			return false, nil
+		}
+		if v.action != "" && result.Action != v.action {
+			c.Infof("captcha action %q, expected %q", result.Action, v.action)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// staticCaptchaVerifier always gives the same answer. For the dev server
+// and tests.
+type staticCaptchaVerifier bool
+
+func (v staticCaptchaVerifier) Verify(c appengine.Context, r *http.Request) (bool, error) {
+	return bool(v), nil
+}
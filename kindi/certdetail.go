@@ -0,0 +1,334 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var oidData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+
+var certificateTmpl *template.Template
+
+func init() {
+	root := template.New("root")
+	root = root.Funcs(template.FuncMap{"formatTime": FormatTime})
+	root = template.Must(root.ParseFiles("tmpl/certificate.html"))
+	certificateTmpl = root.Lookup("certificate.html")
+}
+
+// certDetail is what kindi knows about a stored certificate, parsed from
+// its bytes.
+type certDetail struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Email        string    `json:"email"`
+	Effective    time.Time `json:"effective"`
+	Expires      time.Time `json:"expires"`
+	Supersedes   string    `json:"supersedes,omitempty"`
+	SupersededBy string    `json:"supersededBy,omitempty"`
+
+	Subject            string    `json:"subject"`
+	Issuer             string    `json:"issuer"`
+	EmailAddresses     []string  `json:"emailAddresses"`
+	DNSNames           []string  `json:"dnsNames"`
+	URIs               []string  `json:"uris"`
+	IPAddresses        []string  `json:"ipAddresses"`
+	Serial             string    `json:"serial"`
+	NotBefore          time.Time `json:"notBefore"`
+	NotAfter           time.Time `json:"notAfter"`
+	SignatureAlgorithm string    `json:"signatureAlgorithm"`
+	KeyAlgorithm       string    `json:"keyAlgorithm"`
+	KeySize            int       `json:"keySize"`
+	KeyUsages          []string  `json:"keyUsages"`
+	ExtKeyUsages       []string  `json:"extKeyUsages"`
+	Capabilities       []string  `json:"capabilities"`
+	SHA1               string    `json:"sha1"`
+	SHA256             string    `json:"sha256"`
+}
+
+var keyUsageNames = []struct {
+	usage x509.KeyUsage
+	name  string
+}{
+	{x509.KeyUsageDigitalSignature, "digitalSignature"},
+	{x509.KeyUsageContentCommitment, "contentCommitment"},
+	{x509.KeyUsageKeyEncipherment, "keyEncipherment"},
+	{x509.KeyUsageDataEncipherment, "dataEncipherment"},
+	{x509.KeyUsageKeyAgreement, "keyAgreement"},
+	{x509.KeyUsageCertSign, "keyCertSign"},
+	{x509.KeyUsageCRLSign, "cRLSign"},
+	{x509.KeyUsageEncipherOnly, "encipherOnly"},
+	{x509.KeyUsageDecipherOnly, "decipherOnly"},
+}
+
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "any",
+	x509.ExtKeyUsageServerAuth:      "serverAuth",
+	x509.ExtKeyUsageClientAuth:      "clientAuth",
+	x509.ExtKeyUsageCodeSigning:     "codeSigning",
+	x509.ExtKeyUsageEmailProtection: "emailProtection",
+	x509.ExtKeyUsageTimeStamping:    "timeStamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSPSigning",
+}
+
+func getCertificate(c appengine.Context, userId, id string) (*KindiCertificate, error) {
+	accountKey := datastore.NewKey(c, "KindiAccount", userId, 0, nil)
+	var cert KindiCertificate
+	err := datastore.Get(c, datastore.NewKey(c, "KindiCertificate", id, 0, accountKey), &cert)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// publicKeyInfo returns the name and size in bits of the certificate's
+// public key.
+func publicKeyInfo(cert *x509.Certificate) (string, int) {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA", key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA " + key.Curve.Params().Name, key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return "Ed25519", 256
+	case *dsa.PublicKey:
+		return "DSA", key.P.BitLen()
+	}
+	return cert.PublicKeyAlgorithm.String(), 0
+}
+
+func keyUsages(cert *x509.Certificate) []string {
+	r := make([]string, 0)
+	for _, ku := range keyUsageNames {
+		if cert.KeyUsage&ku.usage != 0 {
+			r = append(r, ku.name)
+		}
+	}
+	return r
+}
+
+func extKeyUsages(cert *x509.Certificate) []string {
+	r := make([]string, 0)
+	for _, eku := range cert.ExtKeyUsage {
+		if name, ok := extKeyUsageNames[eku]; ok {
+			r = append(r, name)
+		} else {
+			r = append(r, fmt.Sprint(eku))
+		}
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		r = append(r, oid.String())
+	}
+	return r
+}
+
+// fingerprint is the colon separated upper case hex of b.
+func fingerprint(b []byte) string {
+	h := strings.ToUpper(hex.EncodeToString(b))
+	parts := make([]string, 0, len(b))
+	for i := 0; i < len(h); i += 2 {
+		parts = append(parts, h[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
+
+func newCertDetail(kc *KindiCertificate) (*certDetail, error) {
+	cert, err := x509.ParseCertificate(kc.CertBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	keyAlg, keySize := publicKeyInfo(cert)
+	sum1 := sha1.Sum(cert.Raw)
+	sum256 := sha256.Sum256(cert.Raw)
+
+	d := &certDetail{
+		ID:           kc.ID,
+		Name:         kc.Name,
+		Email:        kc.Email,
+		Effective:    kc.Effective,
+		Expires:      kc.Expires,
+		Supersedes:   kc.Supersedes,
+		SupersededBy: kc.SupersededBy,
+
+		Subject:            cert.Subject.String(),
+		Issuer:             cert.Issuer.String(),
+		EmailAddresses:     append(make([]string, 0), cert.EmailAddresses...),
+		DNSNames:           append(make([]string, 0), cert.DNSNames...),
+		URIs:               make([]string, 0, len(cert.URIs)),
+		IPAddresses:        make([]string, 0, len(cert.IPAddresses)),
+		Serial:             fingerprint(cert.SerialNumber.Bytes()),
+		NotBefore:          cert.NotBefore,
+		NotAfter:           cert.NotAfter,
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		KeyAlgorithm:       keyAlg,
+		KeySize:            keySize,
+		KeyUsages:          keyUsages(cert),
+		ExtKeyUsages:       extKeyUsages(cert),
+		Capabilities:       keyCapabilities(cert),
+		SHA1:               fingerprint(sum1[:]),
+		SHA256:             fingerprint(sum256[:]),
+	}
+	for _, u := range cert.URIs {
+		d.URIs = append(d.URIs, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		d.IPAddresses = append(d.IPAddresses, ip.String())
+	}
+	return d, nil
+}
+
+// certificateHandler shows one of the user's certificates, as a page or,
+// for API callers, as JSON.
+func (s *server) certificateHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		return badRequest("no_certificate", "no certificate id given")
+	}
+	kc, err := getCertificate(c, u.ID, id)
+	if err == datastore.ErrNoSuchEntity {
+		return notFound("no_certificate", "no such certificate")
+	}
+	if err != nil {
+		return internalError("error reading certificate", err)
+	}
+
+	detail, err := newCertDetail(kc)
+	if err != nil {
+		return internalError("error parsing stored certificate", err)
+	}
+
+	if wantsJSON(r) || r.FormValue("format") == "json" {
+		body, err := json.Marshal(detail)
+		if err != nil {
+			return internalError("error marshalling certificate", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+		return nil
+	}
+
+	err = certificateTmpl.Execute(w, detail)
+	if err != nil {
+		return internalError("error rendering page", err)
+	}
+	return nil
+}
+
+// certsOnlyPKCS7 wraps DER certificates in a degenerate PKCS #7
+// SignedData without signers, the .p7c format.
+func certsOnlyPKCS7(certs ...[]byte) ([]byte, error) {
+	raw := make([]byte, 0)
+	for _, cert := range certs {
+		raw = append(raw, cert...)
+	}
+
+	inner, err := asn1.Marshal(struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      struct{ ContentType asn1.ObjectIdentifier }
+		Certificates     asn1.RawValue
+		SignerInfos      asn1.RawValue
+	}{
+		Version:          1,
+		DigestAlgorithms: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true},
+		ContentInfo:      struct{ ContentType asn1.ObjectIdentifier }{oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw},
+		SignerInfos:      asn1.RawValue{Tag: asn1.TagSet, IsCompound: true},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner},
+	})
+}
+
+// downloadFilename makes a file name out of the certificate's name.
+func downloadFilename(name, ext string) string {
+	clean := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+	if strings.Trim(clean, "_.") == "" {
+		clean = "certificate"
+	}
+	return clean + ext
+}
+
+// certificateDownloadHandler sends one of the user's certificates as
+// PEM, DER or a PKCS #7 certs-only bundle, picked by format.
+func (s *server) certificateDownloadHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		return badRequest("no_certificate", "no certificate id given")
+	}
+	kc, err := getCertificate(c, u.ID, id)
+	if err == datastore.ErrNoSuchEntity {
+		return notFound("no_certificate", "no such certificate")
+	}
+	if err != nil {
+		return internalError("error reading certificate", err)
+	}
+
+	var body []byte
+	var contentType, ext string
+	switch r.FormValue("format") {
+	case "", "pem":
+		body = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: kc.CertBytes})
+		contentType, ext = "application/x-pem-file", ".pem"
+	case "der":
+		body = kc.CertBytes
+		contentType, ext = "application/pkix-cert", ".cer"
+	case "p7c":
+		body, err = certsOnlyPKCS7(kc.CertBytes)
+		if err != nil {
+			return internalError("error encoding certificate", err)
+		}
+		contentType, ext = "application/pkcs7-mime", ".p7c"
+	default:
+		return badRequest("bad_format", "format must be pem, der or p7c")
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", downloadFilename(kc.Name, ext)))
+	w.Write(body)
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"testing"
+)
+
+func TestCertsOnlyPKCS7(t *testing.T) {
+	alice := testLeaf(t, "alice@example.com", x509.ExtKeyUsageEmailProtection, nil).cert
+	bob := testLeaf(t, "bob@example.com", x509.ExtKeyUsageEmailProtection, nil).cert
+
+	tests := []struct {
+		name  string
+		certs []*x509.Certificate
+	}{
+		{"none", nil},
+		{"one", []*x509.Certificate{alice}},
+		{"chain", []*x509.Certificate{alice, bob}},
+	}
+	for _, tt := range tests {
+		ders := make([][]byte, 0, len(tt.certs))
+		for _, cert := range tt.certs {
+			ders = append(ders, cert.Raw)
+		}
+		der, err := certsOnlyPKCS7(ders...)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		var ci contentInfo
+		rest, err := asn1.Unmarshal(der, &ci)
+		if err != nil || len(rest) > 0 || !ci.ContentType.Equal(oidSignedData) {
+			t.Errorf("%s: not a ContentInfo with SignedData: %v", tt.name, err)
+			continue
+		}
+		var sd signedData
+		_, err = asn1.Unmarshal(ci.Content.Bytes, &sd)
+		if err != nil {
+			t.Errorf("%s: bad SignedData: %v", tt.name, err)
+			continue
+		}
+		if len(sd.SignerInfos) != 0 || len(sd.DigestAlgorithms) != 0 {
+			t.Errorf("%s: got %d signers and %d digest algorithms, want none", tt.name, len(sd.SignerInfos), len(sd.DigestAlgorithms))
+		}
+		if !sd.ContentInfo.ContentType.Equal(oidData) {
+			t.Errorf("%s: content type %v, want data", tt.name, sd.ContentInfo.ContentType)
+		}
+		got, err := x509.ParseCertificates(sd.Certificates.Bytes)
+		if err != nil {
+			t.Errorf("%s: bad certificates: %v", tt.name, err)
+			continue
+		}
+		if len(got) != len(tt.certs) {
+			t.Errorf("%s: got %d certificates, want %d", tt.name, len(got), len(tt.certs))
+			continue
+		}
+		for i := range got {
+			if !got[i].Equal(tt.certs[i]) {
+				t.Errorf("%s: certificate %d is %s, want %s", tt.name, i, got[i].Subject, tt.certs[i].Subject)
+			}
+		}
+	}
+}
+
+func TestDownloadFilename(t *testing.T) {
+	tests := []struct {
+		name, ext, want string
+	}{
+		{"work", ".pem", "work.pem"},
+		{"Work 2012-06", ".cer", "Work_2012-06.cer"},
+		{"../etc/passwd", ".pem", ".._etc_passwd.pem"},
+		{"\"quoted\"\r\n", ".p7c", "_quoted___.p7c"},
+		{"", ".pem", "certificate.pem"},
+		{"...", ".pem", "certificate.pem"},
+		{"Zertifikat für Jörg", ".cer", "Zertifikat_f_r_J_rg.cer"},
+	}
+	for _, tt := range tests {
+		if got := downloadFilename(tt.name, tt.ext); got != tt.want {
+			t.Errorf("downloadFilename(%q, %q) = %q, want %q", tt.name, tt.ext, got, tt.want)
+		}
+	}
+}
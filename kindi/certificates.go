@@ -10,11 +10,10 @@ import (
 
 	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 
-	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -30,14 +29,62 @@ type KindiCertificate struct {
 	Processed time.Time
 	Effective time.Time
 	Expires   time.Time
+	// RemindedDays is the smallest reminder window, in days, the owner
+	// was already reminded in. Zero means no reminder was sent.
+	RemindedDays int
+	// Supersedes is the ID of the certificate this one renewed. A renewed
+	// certificate has SupersededBy set and is returned as outgoing until
+	// Retires.
+	Supersedes   string
+	SupersededBy string
+	Retires      time.Time
+	// Flagged is why a re-scan found the key breakable. Flagged
+	// certificates are not returned by lookups.
+	Flagged string `datastore:",noindex"`
+	// Capabilities are what the key may be used for, see keyCapabilities.
+	Capabilities []string
+	// PrimaryFor are the addresses the owner prefers this certificate
+	// for, see primaryFor.
+	PrimaryFor []string
+	// Addresses are the owner's addresses the certificate is published
+	// under, see publishedUnder. Empty means all of them.
+	Addresses []string
 }
 
-func parsePem(pemBytes []byte) (*pem.Block, error) {
-	pemBlock, _ := pem.Decode(pemBytes)
-	if pemBlock == nil {
-		return nil, errors.New("Failed to decode pem")
+// live reports whether lookups return cert at t.
+func (cert *KindiCertificate) live(t time.Time) bool {
+	if cert.Flagged != "" {
+		return false
 	}
-	return pemBlock, nil
+	if !cert.Retires.IsZero() && !cert.Retires.After(t) {
+		return false
+	}
+	return cert.Expires.After(t) && cert.Effective.Before(t)
+}
+
+// rpcCertificate is a lookup result. Type is "certificate", with Bytes
+// the DER certificate, or "key" for a bare key, with Bytes its DER
+// SubjectPublicKeyInfo and the signed description kindi issued for it.
+// Status is "current", or "outgoing" for a renewed certificate still
+// returned until Retires.
+type rpcCertificate struct {
+	kindi.JSONKindiCertificate
+	Type         string     `json:"type"`
+	Algorithm    string     `json:"algorithm"`
+	Status       string     `json:"status"`
+	Retires      *time.Time `json:"retires,omitempty"`
+	Capabilities []string   `json:"capabilities"`
+	Description  []byte     `json:"description,omitempty"`
+	Signature    []byte     `json:"signature,omitempty"`
+}
+
+// certKeyInfo returns the key algorithm and size of the DER certificate.
+func certKeyInfo(der []byte) (string, int) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", 0
+	}
+	return publicKeyInfo(cert)
 }
 
 func earlier(ta time.Time, tb time.Time) time.Time {
@@ -77,79 +124,195 @@ func getUserCertificates(c appengine.Context, user *user.User) ([]KindiCertifica
 	return r, err
 }
 
-func rpcHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+// certOwners returns the distinct user IDs owning the certificates with
+// the given keys.
+func certOwners(keys []*datastore.Key) []string {
+	seen := make(map[string]bool)
+	r := make([]string, 0)
+	for _, key := range keys {
+		userId := key.Parent().StringID()
+		if !seen[userId] {
+			seen[userId] = true
+			r = append(r, userId)
+		}
+	}
+	return r
+}
 
+func (s *server) rpcHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
 	emailStr := r.FormValue("emails")
 	if emailStr == "" {
-		http.Error(w, "no emails given", http.StatusInternalServerError)
-		return
+		return badRequest("no_emails", "no emails given")
 	}
 
-	emails := strings.Split(emailStr, ",")
+	// Emails are looked up in canonical form, each once.
+	emails := make([]string, 0)
+	for _, email := range strings.Split(emailStr, ",") {
+		if strings.TrimSpace(email) == "" {
+			continue
+		}
+		canonical, err := s.canonicalEmail(email)
+		if err != nil {
+			return badRequest("bad_email", fmt.Sprintf("%q is not an email address", strings.TrimSpace(email)))
+		}
+		if !hasAddress(emails, canonical) {
+			emails = append(emails, canonical)
+		}
+	}
 	if len(emails) == 0 {
-		http.Error(w, "no emails given", http.StatusInternalServerError)
-		return
+		return badRequest("no_emails", "no emails given")
+	}
+
+	// purpose narrows the result to keys usable for encrypting or signing.
+	purpose := r.FormValue("purpose")
+	if _, ok := lookupPurposes[purpose]; purpose != "" && !ok {
+		return badRequest("bad_purpose", "purpose must be encrypt or sign")
+	}
+	// Bare keys are only returned to clients asking for them, older ones
+	// expect certificates.
+	withKeys := r.FormValue("keys") == "1"
+
+	sel := r.FormValue("select")
+	if sel == "" {
+		sel = selectAll
+	}
+	if !lookupSelections[sel] {
+		return badRequest("bad_select", "select must be all, primary, newest or strongest")
 	}
 
 	now := time.Now()
-	jsonCerts := make([]kindi.JSONKindiCertificate, 0)
+	jsonCerts := make([]rpcCertificate, 0)
+	orders := make(map[string]string)
+	seen := make(map[[32]byte]bool)
 
 	for _, email := range emails {
-		q := datastore.NewQuery("KindiCertificate").Filter("Email=", email)
+		certs, keys, err := certificatesFor(c, email)
+		if err != nil {
+			return internalError("error fetching certs", err)
+		}
 
-		certs := make([]KindiCertificate, 0)
-		_, err := q.GetAll(c, &certs)
+		owners := certOwners(keys)
+		deleted, err := deletedAccounts(c, owners)
+		if err != nil {
+			return internalError("error fetching certs", err)
+		}
+		err = lookupOrdersOf(c, owners, orders)
 		if err != nil {
-			c.Errorf("error fetching certs: %v", err)
-			http.Error(w, "error fetching certs", http.StatusInternalServerError)
-			return
+			return internalError("error fetching accounts", err)
 		}
 
-		for _, cert := range certs {
+		cands := make([]lookupCandidate, 0, len(certs))
+		for i, cert := range certs {
+			owner := keys[i].Parent().StringID()
+			if t, ok := deleted[owner]; ok && !cert.Processed.After(t) {
+				continue
+			}
 
-			if cert.Expires.After(now) && cert.Effective.Before(now) {
-				jsonCert := kindi.JSONKindiCertificate{
-					Email: cert.Email,
-					Bytes: cert.CertBytes,
+			if cert.live(now) && cert.servesPurpose(purpose) {
+				alg, bits := certKeyInfo(cert.CertBytes)
+				jsonCert := rpcCertificate{
+					JSONKindiCertificate: kindi.JSONKindiCertificate{
+						Email: email,
+						Bytes: cert.CertBytes,
+					},
+					Type:         "certificate",
+					Algorithm:    alg,
+					Status:       "current",
+					Capabilities: cert.capabilities(),
+				}
+				if cert.SupersededBy != "" {
+					retires := cert.Retires
+					jsonCert.Status = "outgoing"
+					jsonCert.Retires = &retires
 				}
-				jsonCerts = append(jsonCerts, jsonCert)
+				cands = append(cands, lookupCandidate{
+					result:    jsonCert,
+					owner:     owner,
+					primary:   cert.primaryFor(email),
+					processed: cert.Processed,
+					expires:   cert.Expires,
+					strength:  securityStrength(alg, bits),
+				})
 			}
 		}
+		jsonCerts = append(jsonCerts, dedupe(selectCandidates(cands, sel, orders), seen)...)
+
+		if !withKeys {
+			continue
+		}
+
+		pubKeys, keys, err := keysFor(c, email)
+		if err != nil {
+			return internalError("error fetching keys", err)
+		}
+
+		owners = certOwners(keys)
+		deleted, err = deletedAccounts(c, owners)
+		if err != nil {
+			return internalError("error fetching keys", err)
+		}
+		err = lookupOrdersOf(c, owners, orders)
+		if err != nil {
+			return internalError("error fetching accounts", err)
+		}
+
+		// Keys are selected apart from certificates, so that hybrid
+		// clients get a key next to the certificate.
+		cands = make([]lookupCandidate, 0, len(pubKeys))
+		for i, key := range pubKeys {
+			owner := keys[i].Parent().StringID()
+			if t, ok := deleted[owner]; ok && !key.Processed.After(t) {
+				continue
+			}
+			if key.live(now) && key.servesPurpose(purpose) {
+				cands = append(cands, lookupCandidate{
+					result: rpcCertificate{
+						JSONKindiCertificate: kindi.JSONKindiCertificate{
+							Email: email,
+							Bytes: key.KeyBytes,
+						},
+						Type:         "key",
+						Algorithm:    key.Algorithm,
+						Status:       "current",
+						Capabilities: keyAlgorithmCapabilities[key.Algorithm],
+						Description:  key.Description,
+						Signature:    key.Signature,
+					},
+					owner:     owner,
+					processed: key.Processed,
+					expires:   key.Expires,
+					strength:  securityStrength(key.Algorithm, 0),
+				})
+			}
+		}
+		jsonCerts = append(jsonCerts, dedupe(selectCandidates(cands, sel, orders), seen)...)
 	}
 
 	bodyJson, err := json.Marshal(jsonCerts)
 	if err != nil {
-		c.Errorf("error marshalling certs: %v", err)
-		http.Error(w, "error marshalling certs", http.StatusInternalServerError)
-		return
+		return internalError("error marshalling certs", err)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprint(w, string(bodyJson))
+	return nil
 }
 
-func deleteHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	u := user.Current(c)
+func (s *server) deleteHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
 	if u == nil {
-		http.Error(w, "no user", http.StatusInternalServerError)
-		return
+		return errNoUser
 	}
 
 	err := r.ParseForm()
 	if err != nil {
-		c.Errorf("error parsing form: %v", err)
-		http.Error(w, "error parsing form", http.StatusInternalServerError)
-		return
+		return newError(http.StatusBadRequest, "bad_form", "error parsing form", err)
 	}
 
 	certIDs := r.Form["certs[]"]
 
 	if certIDs == nil || len(certIDs) == 0 {
-		c.Errorf("no certIDs found")
-		http.Error(w, "no certIDs found", http.StatusInternalServerError)
-		return
+		return badRequest("no_certs", "no certIDs found")
 	}
 
 	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
@@ -174,69 +337,95 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 	}, nil)
 
 	if err != nil {
-		c.Errorf("error deleting certs: %v", err)
-		http.Error(w, "error deleting certs", http.StatusInternalServerError)
-		return
+		return asKindiError(err, "error deleting certs")
 	}
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	fmt.Fprint(w, "ok")
+	return nil
 }
 
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	u := user.Current(c)
+func (s *server) uploadHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
 	if u == nil {
-		http.Error(w, "no user", http.StatusInternalServerError)
-		return
+		return errNoUser
 	}
 
 	certStr := r.FormValue("certificate")
 	if certStr == "" {
-		http.Error(w, "no certificate", http.StatusInternalServerError)
-		return
+		return badRequest("no_certificate", "no certificate")
 	}
 
-	certName := r.FormValue("name")
-	if certName == "" {
-		certName = "Untitled"
+	der, problem := decodeCertificatePEM([]byte(certStr))
+	if problem != nil {
+		return badRequest(problem.Code, problem.Message)
 	}
 
-	pemBlock, err := parsePem([]byte(certStr))
+	_, err := s.storeCertificate(c, u, r.FormValue("name"), der, r.FormValue("renew"))
 	if err != nil {
-		c.Errorf("error parsing PEM block: %v", err)
-		http.Error(w, "error parsing PEM block", http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	x509Cert, err := x509.ParseCertificate(pemBlock.Bytes)
+	err = s.acceptInvites(c, u, r.FormValue("invite"))
 	if err != nil {
-		c.Errorf("error parsing certificate: %v", err)
-		http.Error(w, "error parsing certificate", http.StatusInternalServerError)
-		return
+		c.Errorf("error accepting invites for %s: %v", u.Email, err)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, "ok")
+	return nil
+}
+
+// storeCertificate publishes the DER encoded certificate for u under
+// name, charging one kindi coin, and tells u's watchers about it.
+// Certificates with blocking lint problems are refused. A
+// non-empty renew is the ID of u's certificate the new one supersedes.
+func (s *server) storeCertificate(c appengine.Context, u *user.User, name string, der []byte, renew string) (*KindiCertificate, error) {
+	if name == "" {
+		name = "Untitled"
+	}
+
+	x509Cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, newError(http.StatusBadRequest, "invalid_certificate", "certificate cannot be parsed: "+err.Error(), err)
 	}
 
 	now := time.Now()
 
+	addresses, err := s.accountAddresses(c, u)
+	if err != nil {
+		return nil, internalError("error reading addresses", err)
+	}
+
+	if problems := blocking(s.lintCertificate(x509Cert, addresses, now)); len(problems) > 0 {
+		return nil, errRejected(problems)
+	}
+
 	kindiCert := KindiCertificate{
 		ID:        util.UUID(),
-		Email:     u.Email,
-		Name:      certName,
-		CertBytes: pemBlock.Bytes,
+		Email:     addresses[0],
+		Name:      name,
+		CertBytes: der,
 		Processed: now,
 		Effective: x509Cert.NotBefore,
 		Expires:   earlier(x509Cert.NotAfter, now.AddDate(1, 0, 0)),
+
+		Capabilities: keyCapabilities(x509Cert),
+	}
+	// A certificate naming some of the account's addresses is published
+	// under just those.
+	for _, a := range s.certAddresses(x509Cert) {
+		if hasAddress(addresses, a) {
+			kindiCert.Addresses = append(kindiCert.Addresses, a)
+		}
 	}
 
 	account, err := getAccount(c, u.ID)
 	if err != nil {
-		c.Errorf("error retrieving account: %v", err)
-		http.Error(w, "error retrieving account", http.StatusInternalServerError)
-		return
+		return nil, asKindiError(err, "error retrieving account")
 	}
 
 	if account.KindiCoins <= 0 {
-		http.Error(w, "no kindi coins available", http.StatusInternalServerError)
-		return
+		return nil, errNoCoins
 	}
 
 	account.KindiCoins -= 1
@@ -249,6 +438,13 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 
+		if renew != "" {
+			err = s.supersede(c, accountKey, renew, &kindiCert)
+			if err != nil {
+				return err
+			}
+		}
+
 		_, err = datastore.Put(c, certKey, &kindiCert)
 		if err != nil {
 			return err
@@ -268,11 +464,59 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	}, nil)
 
 	if err != nil {
-		c.Errorf("error saving certificate: %v", err)
-		http.Error(w, "error saving certificate", http.StatusInternalServerError)
-		return
+		return nil, asKindiError(err, "error saving certificate")
 	}
 
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	fmt.Fprint(w, "ok")
+	for _, a := range addresses {
+		if kindiCert.publishedUnder(a, addresses) {
+			notifyWatchersLater.Call(c, a)
+		}
+	}
+	return &kindiCert, nil
+}
+
+// Expired certificates are purged in batches of this size.
+const purgeBatch = 500
+
+// purgeCertificates deletes certificates and bare keys that expired
+// longer than the grace period ago, continuing in a new job while there
+// are more.
+func (s *server) purgeCertificates(c appengine.Context, params url.Values) error {
+	cutoff := time.Now().Add(-s.config.Jobs.CertificateGrace.Duration)
+	pubKeys, err := datastore.NewQuery("KindiKey").Filter("Expires<", cutoff).KeysOnly().Limit(purgeBatch).GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	err = deleteKeys(c, pubKeys)
+	if err != nil {
+		return err
+	}
+
+	q := datastore.NewQuery("KindiCertificate").Filter("Expires<", cutoff).KeysOnly().Limit(purgeBatch)
+	keys, err := q.GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+
+	err = deleteKeys(c, keys)
+	if err != nil {
+		return err
+	}
+
+	owners := make(map[string]bool)
+	for _, key := range keys {
+		if parent := key.Parent(); parent != nil && !owners[parent.StringID()] {
+			owners[parent.StringID()] = true
+			err = memcache.Delete(c, parent.StringID()+"-certs")
+			if err != nil && err != memcache.ErrCacheMiss {
+				return err
+			}
+		}
+	}
+	c.Infof("purged %d expired certificates and %d expired keys", len(keys), len(pubKeys))
+
+	if len(keys) == purgeBatch || len(pubKeys) == purgeBatch {
+		return s.enqueueJob(c, "purge-certificates", "", nil, 0)
+	}
+	return nil
 }
@@ -0,0 +1,568 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const configPath = "kindi.json"
+
+// Duration is a time.Duration that reads and writes itself as a
+// string like "5m" in JSON config files.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+type SellerConfig struct {
+	Identifier      string `json:"identifier"`
+	SecretName      string `json:"secretName"`
+	ItemName        string `json:"itemName"`
+	ItemDescription string `json:"itemDescription"`
+	CurrencyCode    string `json:"currencyCode"`
+}
+
+type PromoConfig struct {
+	Code  string `json:"code"`
+	Count int    `json:"count"`
+}
+
+type CaptchaConfig struct {
+	// Provider is one of "recaptcha-v2", "recaptcha-v3", "hcaptcha",
+	// "turnstile", "always-pass" or "always-fail".
+	Provider string `json:"provider"`
+	// URL overrides the provider's verification endpoint.
+	URL            string `json:"url"`
+	SiteKey        string `json:"siteKey"`
+	PrivateKeyName string `json:"privateKeyName"`
+	// MinScore and Action only apply to reCAPTCHA v3.
+	MinScore float64  `json:"minScore"`
+	Action   string   `json:"action"`
+	Timeout  Duration `json:"timeout"`
+}
+
+type InvitesConfig struct {
+	SecretName string   `json:"secretName"`
+	TTL        Duration `json:"ttl"`
+	// Daily limits on invites per sender, per recipient and overall.
+	SenderLimit    int `json:"senderLimit"`
+	RecipientLimit int `json:"recipientLimit"`
+	DailyCap       int `json:"dailyCap"`
+}
+
+type WatchesConfig struct {
+	TTL            Duration `json:"ttl"`
+	MaxTTL         Duration `json:"maxTtl"`
+	WebhookTimeout Duration `json:"webhookTimeout"`
+}
+
+type SMTPConfig struct {
+	Host         string   `json:"host"`
+	Port         int      `json:"port"`
+	Username     string   `json:"username"`
+	PasswordName string   `json:"passwordName"`
+	RequireTLS   bool     `json:"requireTLS"`
+	Timeout      Duration `json:"timeout"`
+}
+
+type MailConfig struct {
+	// Transport is one of "appengine", "smtp" or "file".
+	Transport string `json:"transport"`
+	// From is the system sender. Mail on behalf of a user sets Reply-To
+	// to the user. Defaults to kindi@<app id>.appspotmail.com on App
+	// Engine.
+	From string     `json:"from"`
+	SMTP SMTPConfig `json:"smtp"`
+	// Dir is the maildir the file transport delivers into.
+	Dir string `json:"dir"`
+	// TemplateDir holds one directory of invite templates per locale.
+	TemplateDir   string `json:"templateDir"`
+	DefaultLocale string `json:"defaultLocale"`
+	// InboundRoots is a PEM file of the CA certificates that certificates
+	// registered by mail have to chain to. Without it registering by mail
+	// is turned off.
+	InboundRoots string `json:"inboundRoots"`
+}
+
+type CSRFConfig struct {
+	SecretName string `json:"secretName"`
+}
+
+type SecretsConfig struct {
+	// Provider is one of "datastore", "file" or "env".
+	Provider string   `json:"provider"`
+	Dir      string   `json:"dir"`
+	TTL      Duration `json:"ttl"`
+}
+
+type JobsConfig struct {
+	// Runner is "taskqueue", or "inprocess" to run jobs right away in
+	// the request that enqueues them.
+	Runner string `json:"runner"`
+	Queue  string `json:"queue"`
+	// A job is retried with exponential backoff between MinBackoff and
+	// MaxBackoff until it ran MaxAttempts times.
+	MaxAttempts int      `json:"maxAttempts"`
+	MinBackoff  Duration `json:"minBackoff"`
+	MaxBackoff  Duration `json:"maxBackoff"`
+	// CertificateGrace is how long expired certificates are kept.
+	CertificateGrace Duration `json:"certificateGrace"`
+}
+
+type RemindersConfig struct {
+	// Days are the windows before expiry, in days, in which owners are
+	// reminded to renew a certificate. Each window reminds once.
+	Days []int `json:"days"`
+}
+
+type RenewalsConfig struct {
+	// Overlap is how long a renewed certificate is still returned, as
+	// outgoing, next to the one that superseded it.
+	Overlap Duration `json:"overlap"`
+}
+
+type KeysConfig struct {
+	MinRSABits int `json:"minRSABits"`
+	MinECBits  int `json:"minECBits"`
+	// Blocklist is a file of compromised key fingerprints, one hex
+	// fingerprint per line: the SHA-256 of the SubjectPublicKeyInfo, or
+	// the SHA-1 of "Modulus=<HEX>\n" in full or as its last 20 digits
+	// like Debian's openssl-blacklist files.
+	Blocklist string `json:"blocklist"`
+	// IssuerSecretName names the secret kindi's Ed25519 key for signing
+	// bare key descriptions is derived from.
+	IssuerSecretName string `json:"issuerSecretName"`
+}
+
+// UsageConfig is the key usage policy for uploads. Usages that are not
+// required only draw warnings.
+type UsageConfig struct {
+	// RequireEncryption refuses keys that can neither encipher keys nor
+	// agree on them.
+	RequireEncryption bool `json:"requireEncryption"`
+	// RequireEmailProtection refuses certificates whose extended key
+	// usage does not include emailProtection.
+	RequireEmailProtection bool `json:"requireEmailProtection"`
+	// AllowMissingExtKeyUsage accepts certificates without any extended
+	// key usage, which allows every usage.
+	AllowMissingExtKeyUsage bool `json:"allowMissingExtKeyUsage"`
+}
+
+// CAConfig sets up issuing certificates from CSRs. An empty Signer turns
+// it off.
+type CAConfig struct {
+	// Signer is "file", which reads the CA key from KeyFile, or "kms",
+	// which keeps it in the secret named KeyName.
+	Signer string `json:"signer"`
+	// Certificate is the PEM file of the intermediate CA certificate.
+	Certificate string `json:"certificate"`
+	KeyFile     string `json:"keyFile"`
+	KeyName     string `json:"keyName"`
+	// Validity is how long issued certificates are valid.
+	Validity Duration `json:"validity"`
+}
+
+// EmailsConfig limits the addresses an account can add.
+type EmailsConfig struct {
+	// Max is how many addresses besides the login email an account can
+	// have, verified or not.
+	Max int `json:"max"`
+	// HourlyLimit caps how many verification mails an account can ask
+	// for in an hour.
+	HourlyLimit int `json:"hourlyLimit"`
+	// VerifyTTL is how long a verification link is valid.
+	VerifyTTL Duration `json:"verifyTtl"`
+	// FoldCase lists the domains, in punycode, whose mailboxes ignore the
+	// case of the local part. Elsewhere Alice@ and alice@ are different
+	// addresses.
+	FoldCase []string `json:"foldCase"`
+	// StripTags lists the domains whose mailboxes take
+	// +tags; a tagged address is the same as the untagged one.
+	StripTags []string `json:"stripTags"`
+	// IgnoreDots lists the domains whose mailboxes ignore dots in the
+	// local part, like gmail.com.
+	IgnoreDots []string `json:"ignoreDots"`
+}
+
+type Config struct {
+	// BaseURL is used for links in emails. Defaults to the request host.
+	BaseURL string        `json:"baseURL"`
+	Seller  SellerConfig  `json:"seller"`
+	Promo   PromoConfig   `json:"promo"`
+	Captcha CaptchaConfig `json:"captcha"`
+	Invites InvitesConfig `json:"invites"`
+	Watches WatchesConfig `json:"watches"`
+	Mail    MailConfig    `json:"mail"`
+	CSRF    CSRFConfig    `json:"csrf"`
+	Secrets SecretsConfig `json:"secrets"`
+	Jobs    JobsConfig    `json:"jobs"`
+
+	Reminders RemindersConfig `json:"reminders"`
+	Renewals  RenewalsConfig  `json:"renewals"`
+	Keys      KeysConfig      `json:"keys"`
+	Usage     UsageConfig     `json:"usage"`
+	CA        CAConfig        `json:"ca"`
+	Emails    EmailsConfig    `json:"emails"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Seller: SellerConfig{
+			SecretName:   "seller-secret",
+			CurrencyCode: "USD",
+		},
+		Captcha: CaptchaConfig{
+			Provider:       "recaptcha-v2",
+			PrivateKeyName: "captcha-private-key",
+			MinScore:       0.5,
+			Action:         "invite",
+			Timeout:        Duration{5 * time.Second},
+		},
+		Invites: InvitesConfig{
+			SecretName: "invite-key",
+			TTL:        Duration{30 * 24 * time.Hour},
+
+			SenderLimit:    20,
+			RecipientLimit: 3,
+			DailyCap:       1000,
+		},
+		Watches: WatchesConfig{
+			TTL:            Duration{30 * 24 * time.Hour},
+			MaxTTL:         Duration{365 * 24 * time.Hour},
+			WebhookTimeout: Duration{10 * time.Second},
+		},
+		Mail: MailConfig{
+			Transport: "appengine",
+			SMTP: SMTPConfig{
+				Port:         587,
+				PasswordName: "smtp-password",
+				RequireTLS:   true,
+				Timeout:      Duration{30 * time.Second},
+			},
+			Dir: "maildir",
+
+			TemplateDir:   "tmpl/mail",
+			DefaultLocale: "en",
+		},
+		CSRF: CSRFConfig{
+			SecretName: "csrf-key",
+		},
+		Secrets: SecretsConfig{
+			Provider: "datastore",
+			Dir:      "secrets",
+			TTL:      Duration{5 * time.Minute},
+		},
+		Jobs: JobsConfig{
+			Runner:      "taskqueue",
+			Queue:       "default",
+			MaxAttempts: 5,
+			MinBackoff:  Duration{time.Minute},
+			MaxBackoff:  Duration{time.Hour},
+
+			CertificateGrace: Duration{30 * 24 * time.Hour},
+		},
+		Reminders: RemindersConfig{
+			Days: []int{30, 7, 1},
+		},
+		Renewals: RenewalsConfig{
+			Overlap: Duration{7 * 24 * time.Hour},
+		},
+		Keys: KeysConfig{
+			MinRSABits: 2048,
+			MinECBits:  256,
+
+			IssuerSecretName: "key-issuer",
+		},
+		Usage: UsageConfig{
+			RequireEncryption:      true,
+			RequireEmailProtection: true,
+		},
+		CA: CAConfig{
+			KeyName:  "ca-key",
+			Validity: Duration{30 * 24 * time.Hour},
+		},
+		Emails: EmailsConfig{
+			Max:         10,
+			HourlyLimit: 5,
+			VerifyTTL:   Duration{48 * time.Hour},
+		},
+	}
+}
+
+// loadConfig reads the config file at path, if it exists, on top of the
+// defaults and then applies KINDI_* environment overrides.
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("config %s: %v", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(os.Getenv); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) applyEnv(getenv func(string) string) error {
+	strs := map[string]*string{
+		"KINDI_SELLER_IDENTIFIER":        &cfg.Seller.Identifier,
+		"KINDI_SELLER_SECRET_NAME":       &cfg.Seller.SecretName,
+		"KINDI_SELLER_ITEM_NAME":         &cfg.Seller.ItemName,
+		"KINDI_SELLER_ITEM_DESCRIPTION":  &cfg.Seller.ItemDescription,
+		"KINDI_SELLER_CURRENCY_CODE":     &cfg.Seller.CurrencyCode,
+		"KINDI_PROMO_CODE":               &cfg.Promo.Code,
+		"KINDI_CAPTCHA_PROVIDER":         &cfg.Captcha.Provider,
+		"KINDI_CAPTCHA_URL":              &cfg.Captcha.URL,
+		"KINDI_CAPTCHA_SITE_KEY":         &cfg.Captcha.SiteKey,
+		"KINDI_CAPTCHA_PRIVATE_KEY_NAME": &cfg.Captcha.PrivateKeyName,
+		"KINDI_BASE_URL":                 &cfg.BaseURL,
+		"KINDI_INVITES_SECRET_NAME":      &cfg.Invites.SecretName,
+		"KINDI_MAIL_TRANSPORT":           &cfg.Mail.Transport,
+		"KINDI_MAIL_FROM":                &cfg.Mail.From,
+		"KINDI_MAIL_SMTP_HOST":           &cfg.Mail.SMTP.Host,
+		"KINDI_MAIL_SMTP_USERNAME":       &cfg.Mail.SMTP.Username,
+		"KINDI_MAIL_DIR":                 &cfg.Mail.Dir,
+		"KINDI_MAIL_TEMPLATE_DIR":        &cfg.Mail.TemplateDir,
+		"KINDI_MAIL_DEFAULT_LOCALE":      &cfg.Mail.DefaultLocale,
+		"KINDI_MAIL_INBOUND_ROOTS":       &cfg.Mail.InboundRoots,
+		"KINDI_CSRF_SECRET_NAME":         &cfg.CSRF.SecretName,
+		"KINDI_SECRETS_PROVIDER":         &cfg.Secrets.Provider,
+		"KINDI_SECRETS_DIR":              &cfg.Secrets.Dir,
+		"KINDI_JOBS_RUNNER":              &cfg.Jobs.Runner,
+		"KINDI_JOBS_QUEUE":               &cfg.Jobs.Queue,
+		"KINDI_KEYS_BLOCKLIST":           &cfg.Keys.Blocklist,
+		"KINDI_KEYS_ISSUER_SECRET_NAME":  &cfg.Keys.IssuerSecretName,
+		"KINDI_CA_SIGNER":                &cfg.CA.Signer,
+		"KINDI_CA_CERTIFICATE":           &cfg.CA.Certificate,
+		"KINDI_CA_KEY_FILE":              &cfg.CA.KeyFile,
+		"KINDI_CA_KEY_NAME":              &cfg.CA.KeyName,
+	}
+	for name, p := range strs {
+		if v := getenv(name); v != "" {
+			*p = v
+		}
+	}
+
+	if v := getenv("KINDI_PROMO_COUNT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("KINDI_PROMO_COUNT: %v", err)
+		}
+		cfg.Promo.Count = n
+	}
+
+	if v := getenv("KINDI_SECRETS_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("KINDI_SECRETS_TTL: %v", err)
+		}
+		cfg.Secrets.TTL = Duration{d}
+	}
+	return nil
+}
+
+func (cfg *Config) validate() error {
+	var problems []string
+
+	if cfg.Seller.Identifier == "" {
+		problems = append(problems, "seller.identifier is required")
+	}
+	if cfg.Seller.SecretName == "" {
+		problems = append(problems, "seller.secretName is required")
+	}
+	if cfg.Seller.CurrencyCode == "" {
+		problems = append(problems, "seller.currencyCode is required")
+	}
+	if cfg.Promo.Count < 0 {
+		problems = append(problems, "promo.count must not be negative")
+	}
+	if cfg.Promo.Code != "" && cfg.Promo.Count == 0 {
+		problems = append(problems, "promo.count must be set when promo.code is set")
+	}
+	switch cfg.Captcha.Provider {
+	case "always-pass", "always-fail":
+	default:
+		if _, ok := siteVerifyProviders[cfg.Captcha.Provider]; !ok {
+			problems = append(problems, fmt.Sprintf("captcha.provider %q is not supported", cfg.Captcha.Provider))
+		}
+		if cfg.Captcha.PrivateKeyName == "" {
+			problems = append(problems, "captcha.privateKeyName is required")
+		}
+		if cfg.Captcha.SiteKey == "" {
+			problems = append(problems, "captcha.siteKey is required")
+		}
+		if cfg.Captcha.Timeout.Duration <= 0 {
+			problems = append(problems, "captcha.timeout must be positive")
+		}
+		if cfg.Captcha.MinScore < 0 || cfg.Captcha.MinScore > 1 {
+			problems = append(problems, "captcha.minScore must be between 0 and 1")
+		}
+	}
+	if cfg.Invites.SecretName == "" {
+		problems = append(problems, "invites.secretName is required")
+	}
+	if cfg.Invites.TTL.Duration <= 0 {
+		problems = append(problems, "invites.ttl must be positive")
+	}
+	if cfg.Invites.SenderLimit < 1 || cfg.Invites.RecipientLimit < 1 || cfg.Invites.DailyCap < 1 {
+		problems = append(problems, "invites.senderLimit, invites.recipientLimit and invites.dailyCap must be positive")
+	}
+	if cfg.Watches.TTL.Duration <= 0 || cfg.Watches.MaxTTL.Duration < cfg.Watches.TTL.Duration {
+		problems = append(problems, "watches.ttl must be positive and at most watches.maxTtl")
+	}
+	if cfg.Watches.WebhookTimeout.Duration <= 0 {
+		problems = append(problems, "watches.webhookTimeout must be positive")
+	}
+	if cfg.Mail.From != "" {
+		if _, err := mail.ParseAddress(cfg.Mail.From); err != nil {
+			problems = append(problems, fmt.Sprintf("mail.from: %v", err))
+		}
+	}
+	switch cfg.Mail.Transport {
+	case "appengine":
+	case "smtp":
+		if cfg.Mail.From == "" {
+			problems = append(problems, "mail.from is required for the smtp transport")
+		}
+		if cfg.Mail.SMTP.Host == "" || cfg.Mail.SMTP.Port <= 0 {
+			problems = append(problems, "mail.smtp.host and mail.smtp.port are required for the smtp transport")
+		}
+		if cfg.Mail.SMTP.Username != "" && cfg.Mail.SMTP.PasswordName == "" {
+			problems = append(problems, "mail.smtp.passwordName is required with mail.smtp.username")
+		}
+		if cfg.Mail.SMTP.Timeout.Duration <= 0 {
+			problems = append(problems, "mail.smtp.timeout must be positive")
+		}
+	case "file":
+		if cfg.Mail.From == "" {
+			problems = append(problems, "mail.from is required for the file transport")
+		}
+		if cfg.Mail.Dir == "" {
+			problems = append(problems, "mail.dir is required for the file transport")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("mail.transport %q is not one of appengine, smtp, file", cfg.Mail.Transport))
+	}
+	if cfg.Mail.TemplateDir == "" || cfg.Mail.DefaultLocale == "" {
+		problems = append(problems, "mail.templateDir and mail.defaultLocale are required")
+	}
+	if cfg.CSRF.SecretName == "" {
+		problems = append(problems, "csrf.secretName is required")
+	}
+	switch cfg.Secrets.Provider {
+	case "datastore", "env":
+	case "file":
+		if cfg.Secrets.Dir == "" {
+			problems = append(problems, "secrets.dir is required for the file provider")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("secrets.provider %q is not one of datastore, file, env", cfg.Secrets.Provider))
+	}
+	if cfg.Secrets.TTL.Duration < 0 {
+		problems = append(problems, "secrets.ttl must not be negative")
+	}
+	switch cfg.Jobs.Runner {
+	case "taskqueue":
+		if cfg.Jobs.Queue == "" {
+			problems = append(problems, "jobs.queue is required for the taskqueue runner")
+		}
+	case "inprocess":
+	default:
+		problems = append(problems, fmt.Sprintf("jobs.runner %q is not one of taskqueue, inprocess", cfg.Jobs.Runner))
+	}
+	if cfg.Jobs.MaxAttempts < 1 {
+		problems = append(problems, "jobs.maxAttempts must be positive")
+	}
+	if cfg.Jobs.MinBackoff.Duration <= 0 || cfg.Jobs.MaxBackoff.Duration < cfg.Jobs.MinBackoff.Duration {
+		problems = append(problems, "jobs.minBackoff must be positive and at most jobs.maxBackoff")
+	}
+	if cfg.Jobs.CertificateGrace.Duration < 0 {
+		problems = append(problems, "jobs.certificateGrace must not be negative")
+	}
+	for _, d := range cfg.Reminders.Days {
+		if d < 1 {
+			problems = append(problems, "reminders.days must be positive")
+			break
+		}
+	}
+	if cfg.Renewals.Overlap.Duration < 0 {
+		problems = append(problems, "renewals.overlap must not be negative")
+	}
+	if cfg.Keys.MinRSABits < 1024 || cfg.Keys.MinECBits < 160 {
+		problems = append(problems, "keys.minRSABits must be at least 1024 and keys.minECBits at least 160")
+	}
+	if cfg.Keys.IssuerSecretName == "" {
+		problems = append(problems, "keys.issuerSecretName is required")
+	}
+	if cfg.Emails.Max < 0 || cfg.Emails.HourlyLimit <= 0 {
+		problems = append(problems, "emails.max must not be negative and emails.hourlyLimit must be positive")
+	}
+	if cfg.Emails.VerifyTTL.Duration <= 0 {
+		problems = append(problems, "emails.verifyTtl must be positive")
+	}
+	domains := append(append(append([]string{}, cfg.Emails.FoldCase...), cfg.Emails.StripTags...), cfg.Emails.IgnoreDots...)
+	for _, d := range domains {
+		if a, err := asciiDomain(d); err != nil || a != d {
+			problems = append(problems, fmt.Sprintf("emails.foldCase, emails.stripTags and emails.ignoreDots take lower case punycode domains, not %q", d))
+		}
+	}
+	switch cfg.CA.Signer {
+	case "":
+	case "file", "kms":
+		if cfg.CA.Certificate == "" {
+			problems = append(problems, "ca.certificate is required")
+		}
+		if cfg.CA.Signer == "file" && cfg.CA.KeyFile == "" {
+			problems = append(problems, "ca.keyFile is required for the file signer")
+		}
+		if cfg.CA.Signer == "kms" && cfg.CA.KeyName == "" {
+			problems = append(problems, "ca.keyName is required for the kms signer")
+		}
+		if cfg.CA.Validity.Duration <= 0 {
+			problems = append(problems, "ca.validity must be positive")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("ca.signer %q is not supported", cfg.CA.Signer))
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid kindi config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
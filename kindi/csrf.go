@@ -0,0 +1,144 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/user"
+
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	csrfHeader   = "X-CSRF-Token"
+	csrfField    = "csrf_token"
+	csrfTokenTTL = 24 * time.Hour
+	oauthScope   = "https://www.googleapis.com/auth/userinfo.email"
+)
+
+var (
+	errMethodNotAllowed = newError(http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed", nil)
+	errBadOrigin        = newError(http.StatusForbidden, "bad_origin", "cross-site request refused", nil)
+	errBadCSRFToken     = newError(http.StatusForbidden, "bad_csrf_token", "invalid or expired csrf token", nil)
+)
+
+func hasBearerToken(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// currentUser returns the user behind the request. API clients sending an
+// OAuth bearer token are authenticated through it, browsers through the
+// login cookie.
+func currentUser(c appengine.Context, r *http.Request) *user.User {
+	if hasBearerToken(r) {
+		u, err := user.CurrentOAuth(c, oauthScope)
+		if err != nil {
+			c.Infof("error authenticating bearer token: %v", err)
+			return nil
+		}
+		return u
+	}
+	return user.Current(c)
+}
+
+// csrfToken issues a synchronizer token bound to userId. The token is
+// "<unix time>.<hmac>" so it can be checked without server side state.
+func (s *server) csrfToken(c appengine.Context, userId string) (string, error) {
+	key, err := s.secrets.Secret(c, s.config.CSRF.SecretName)
+	if err != nil {
+		return "", err
+	}
+	issued := strconv.FormatInt(time.Now().Unix(), 10)
+	return issued + "." + csrfMAC(key, userId, issued), nil
+}
+
+func csrfMAC(key, userId, issued string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(userId + "|" + issued))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *server) validCSRFToken(c appengine.Context, userId, token string) (bool, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false, nil
+	}
+	secs, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false, nil
+	}
+	if time.Since(time.Unix(secs, 0)) > csrfTokenTTL {
+		return false, nil
+	}
+
+	key, err := s.secrets.Secret(c, s.config.CSRF.SecretName)
+	if err != nil {
+		return false, err
+	}
+	expected := csrfMAC(key, userId, parts[0])
+	return hmac.Equal([]byte(expected), []byte(parts[1])), nil
+}
+
+// sameOrigin checks the Origin header, falling back to Referer, against
+// the host the request was sent to. Requests carrying neither are let
+// through; the csrf token still has to match.
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" || source == "null" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return r.Header.Get("Origin") != "null"
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// protect wraps handlers that change state. They only accept POST, and
+// cookie authenticated requests must come from our own pages and carry a
+// valid csrf token. Bearer token clients are exempt from the last two
+// checks since browsers never attach that header cross-site.
+func (s *server) protect(fn handlerFunc) handlerFunc {
+	return func(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			return errMethodNotAllowed
+		}
+
+		if hasBearerToken(r) {
+			return fn(c, w, r)
+		}
+
+		if !sameOrigin(r) {
+			return errBadOrigin
+		}
+
+		u := user.Current(c)
+		if u == nil {
+			return errNoUser
+		}
+
+		token := r.Header.Get(csrfHeader)
+		if token == "" {
+			token = r.FormValue(csrfField)
+		}
+		ok, err := s.validCSRFToken(c, u.ID, token)
+		if err != nil {
+			return internalError("error checking csrf token", err)
+		}
+		if !ok {
+			return errBadCSRFToken
+		}
+		return fn(c, w, r)
+	}
+}
@@ -3,17 +3,132 @@
 package kindi
 
 import (
+	"appengine/delay"
+
+	"crypto/x509"
 	"net/http"
 )
 
+// server carries the dependencies the handlers need.
+type server struct {
+	config  *Config
+	secrets SecretProvider
+	captcha CaptchaVerifier
+	mailer  Mailer
+	keys    *keyChecker
+	ca      CASigner
+
+	mailTmpls *mailBundle
+	// inboundRoots is nil when registering by mail is turned off.
+	inboundRoots *x509.CertPool
+
+	jobs     JobRunner
+	jobFuncs map[string]jobFunc
+}
+
+func newServer(cfg *Config) (*server, error) {
+	mailTmpls, err := loadMailBundle(cfg.Mail.TemplateDir, cfg.Mail.DefaultLocale)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := newKeyChecker(cfg.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := newSecretProvider(cfg.Secrets)
+	ca, err := newCASigner(cfg.CA, secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	inboundRoots, err := loadCertPool(cfg.Mail.InboundRoots)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &server{
+		config:  cfg,
+		secrets: secrets,
+		captcha: newCaptchaVerifier(cfg.Captcha, secrets),
+		mailer:  newMailer(cfg.Mail, secrets),
+		keys:    keys,
+		ca:      ca,
+
+		mailTmpls:    mailTmpls,
+		inboundRoots: inboundRoots,
+	}
+	s.jobs = newJobRunner(cfg.Jobs, s.runJob)
+	s.jobFuncs = map[string]jobFunc{
+		"purge-certificates":  s.purgeCertificates,
+		"promo-counters":      s.recomputePromoCounters,
+		"retry-mail":          s.retryMail,
+		"expiry-reminders":    s.sendExpiryReminders,
+		"retire-certificates": s.retireCertificates,
+		"rescan-keys":         s.rescanKeys,
+		"purge-jobs":          s.purgeJobs,
+		"purge-exports":       s.purgeExports,
+		"canonicalize-emails": s.canonicalizeEmails,
+	}
+	return s, nil
+}
+
 func init() {
-	http.HandleFunc("/manage", manageHandler)
-	http.HandleFunc("/jot", jotHandler)
-	http.HandleFunc("/coins", coinsHandler)
-	http.HandleFunc("/buy", buyHandler)
-	http.HandleFunc("/upload", uploadHandler)
-	http.HandleFunc("/delete", deleteHandler)
-	http.HandleFunc("/invite", inviteHandler)
-	http.HandleFunc("/lookup", lookupHandler)
-	http.HandleFunc("/rpc/v1", rpcHandler)
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		panic(err)
+	}
+	s, err := newServer(cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	exportLater = delay.Func("export", s.runExport)
+	deleteAccountLater = delay.Func("deleteAccount", deleteAccountData)
+	notifyWatchersLater = delay.Func("notifyWatchers", s.notifyWatchers)
+	bulkInviteLater = delay.Func("bulkInvite", s.processBulkInvite)
+
+	http.HandleFunc("/manage", s.handle(s.manageHandler))
+	http.HandleFunc("/jot", s.handle(s.protect(s.jotHandler)))
+	http.HandleFunc("/coins", s.handle(s.coinsHandler))
+	http.HandleFunc("/buy", s.handle(s.buyHandler))
+	http.HandleFunc("/upload", s.handle(s.protect(s.uploadHandler)))
+	http.HandleFunc("/upload/check", s.handle(s.protect(s.uploadCheckHandler)))
+	http.HandleFunc("/issue", s.handle(s.protect(s.issueHandler)))
+	http.HandleFunc("/delete", s.handle(s.protect(s.deleteHandler)))
+	http.HandleFunc("/invite", s.handle(s.protect(s.inviteHandler)))
+	http.HandleFunc("/invite/preview", s.handle(s.invitePreviewHandler))
+	http.HandleFunc("/invite/bulk", s.handle(s.protect(s.bulkInviteHandler)))
+	http.HandleFunc("/invite/bulk/status", s.handle(s.bulkInviteStatusHandler))
+	http.HandleFunc("/lookup", s.handle(s.lookupHandler))
+	http.HandleFunc("/accept", s.handle(s.acceptHandler))
+	http.HandleFunc("/unsubscribe", s.handle(s.unsubscribeHandler))
+	http.HandleFunc("/_ah/bounce", s.handle(s.bounceHandler))
+	http.HandleFunc("/_ah/mail/", s.handle(s.inboundMailHandler))
+	http.HandleFunc("/rpc/v1", s.handle(s.rpcHandler))
+	http.HandleFunc("/rpc/v1/issuer", s.handle(s.issuerHandler))
+	http.HandleFunc("/keys", s.handle(s.keysHandler))
+	http.HandleFunc("/keys/upload", s.handle(s.protect(s.keyUploadHandler)))
+	http.HandleFunc("/keys/delete", s.handle(s.protect(s.keyDeleteHandler)))
+	http.HandleFunc("/keys/addresses", s.handle(s.protect(s.keyAddressesHandler)))
+	http.HandleFunc("/watch", s.handle(s.protect(s.watchHandler)))
+	http.HandleFunc("/watch/cancel", s.handle(s.protect(s.cancelWatchHandler)))
+	http.HandleFunc("/account/delete", s.handle(s.protect(s.deleteAccountHandler)))
+	http.HandleFunc("/account/reminders", s.handle(s.protect(s.remindersHandler)))
+	http.HandleFunc("/account/lookup-order", s.handle(s.protect(s.lookupOrderHandler)))
+	http.HandleFunc("/account/emails", s.handle(s.emailsHandler))
+	http.HandleFunc("/account/emails/add", s.handle(s.protect(s.addEmailHandler)))
+	http.HandleFunc("/account/emails/verify", s.handle(s.verifyEmailHandler))
+	http.HandleFunc("/account/emails/remove", s.handle(s.protect(s.removeEmailHandler)))
+	http.HandleFunc("/certificates/detail", s.handle(s.certificateHandler))
+	http.HandleFunc("/certificates/download", s.handle(s.certificateDownloadHandler))
+	http.HandleFunc("/certificates/history", s.handle(s.historyHandler))
+	http.HandleFunc("/certificates/primary", s.handle(s.protect(s.primaryHandler)))
+	http.HandleFunc("/certificates/addresses", s.handle(s.protect(s.certificateAddressesHandler)))
+	http.HandleFunc("/export", s.handle(s.protect(s.exportHandler)))
+	http.HandleFunc("/export/status", s.handle(s.exportStatusHandler))
+	http.HandleFunc("/export/download", s.handle(s.exportDownloadHandler))
+	http.HandleFunc("/jobs/run", s.handle(s.jobRunHandler))
+	http.HandleFunc("/jobs/cron/", s.handle(s.jobCronHandler))
 }
@@ -0,0 +1,601 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"appengine/user"
+
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// KindiEmail is an address of an account besides its login email. It is
+// a child of the KindiAccount keyed by the canonical address. Until
+// Verified, TokenHash is the SHA-256 of the token mailed to the address.
+type KindiEmail struct {
+	Address      string
+	Verified     bool
+	Added        time.Time
+	Confirmed    time.Time
+	TokenHash    string `datastore:",noindex"`
+	TokenExpires time.Time
+}
+
+type emailEntry struct {
+	Address  string `json:"address"`
+	Verified bool   `json:"verified"`
+	Login    bool   `json:"login"`
+}
+
+func emailKey(c appengine.Context, userId, address string) *datastore.Key {
+	accountKey := datastore.NewKey(c, "KindiAccount", userId, 0, nil)
+	return datastore.NewKey(c, "KindiEmail", address, 0, accountKey)
+}
+
+// hasAddress reports whether the canonical addresses include address.
+// They are compared exactly, as the case of a local part may matter.
+func hasAddress(addresses []string, address string) bool {
+	for _, a := range addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutAddress returns addresses without address.
+func withoutAddress(addresses []string, address string) []string {
+	r := make([]string, 0, len(addresses))
+	for _, a := range addresses {
+		if a != address {
+			r = append(r, a)
+		}
+	}
+	return r
+}
+
+func hasAnyAddress(addresses, wanted []string) bool {
+	for _, a := range wanted {
+		if hasAddress(addresses, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// accountAddresses returns the verified addresses of u in canonical form,
+// its login email first.
+func (s *server) accountAddresses(c appengine.Context, u *user.User) ([]string, error) {
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	emails := make([]KindiEmail, 0)
+	_, err := datastore.NewQuery("KindiEmail").Ancestor(accountKey).GetAll(c, &emails)
+	if err != nil {
+		return nil, err
+	}
+
+	r := []string{s.canonical(u.Email)}
+	for _, e := range emails {
+		if a := s.canonical(e.Address); e.Verified && !hasAddress(r, a) {
+			r = append(r, a)
+		}
+	}
+	return r, nil
+}
+
+// publishedUnder reports whether cert is returned for address, given the
+// verified addresses of its owner. Certificates without chosen addresses
+// are published under all of them, and under the address they were
+// uploaded for.
+func (cert *KindiCertificate) publishedUnder(address string, owned []string) bool {
+	if len(cert.Addresses) > 0 {
+		return hasAddress(cert.Addresses, address)
+	}
+	return cert.Email == address || hasAddress(owned, address)
+}
+
+// addressOwners returns the IDs of the accounts the canonical address is
+// the login email or a verified address of.
+func addressOwners(c appengine.Context, address string) ([]string, error) {
+	keys, err := datastore.NewQuery("KindiAccount").Filter("Canonical=", address).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Accounts canonicalizeEmails has not got to yet only match by Email.
+	uncanonical, err := datastore.NewQuery("KindiAccount").Filter("Email=", address).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, uncanonical...)
+	aliases, err := datastore.NewQuery("KindiEmail").Filter("Address=", address).Filter("Verified=", true).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	r := make([]string, 0)
+	for _, key := range keys {
+		if id := key.StringID(); !seen[id] {
+			seen[id] = true
+			r = append(r, id)
+		}
+	}
+	for _, key := range aliases {
+		if id := key.Parent().StringID(); !seen[id] {
+			seen[id] = true
+			r = append(r, id)
+		}
+	}
+	return r, nil
+}
+
+// certificatesFor returns the certificates published under the canonical
+// address: those uploaded for it and those of every account owning it, as
+// far as their chosen addresses allow.
+func certificatesFor(c appengine.Context, address string) ([]KindiCertificate, []*datastore.Key, error) {
+	certs := make([]KindiCertificate, 0)
+	keys, err := datastore.NewQuery("KindiCertificate").Filter("Email=", address).GetAll(c, &certs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := make([]KindiCertificate, 0, len(certs))
+	rkeys := make([]*datastore.Key, 0, len(keys))
+	seen := make(map[string]bool)
+	for i := range certs {
+		seen[keys[i].Encode()] = true
+		if certs[i].publishedUnder(address, nil) {
+			r = append(r, certs[i])
+			rkeys = append(rkeys, keys[i])
+		}
+	}
+
+	owners, err := addressOwners(c, address)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, owner := range owners {
+		accountKey := datastore.NewKey(c, "KindiAccount", owner, 0, nil)
+		owned := make([]KindiCertificate, 0)
+		ownedKeys, err := datastore.NewQuery("KindiCertificate").Ancestor(accountKey).GetAll(c, &owned)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range owned {
+			if seen[ownedKeys[i].Encode()] || !owned[i].publishedUnder(address, []string{address}) {
+				continue
+			}
+			seen[ownedKeys[i].Encode()] = true
+			r = append(r, owned[i])
+			rkeys = append(rkeys, ownedKeys[i])
+		}
+	}
+	return r, rkeys, nil
+}
+
+// syncLoginEmail follows a change of u's login email: the account takes
+// the new one and keeps the old one as a verified address, so the
+// certificates filed under it stay published.
+func (s *server) syncLoginEmail(c appengine.Context, u *user.User, account *KindiAccount) error {
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	canonical := s.canonical(u.Email)
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		err := datastore.Get(c, accountKey, account)
+		if err != nil {
+			return err
+		}
+		if account.Email == u.Email && account.Canonical == canonical {
+			return nil
+		}
+
+		now := time.Now()
+		if old := s.canonical(account.Email); account.Email != "" && old != canonical {
+			oldEmail := KindiEmail{Address: old, Verified: true, Added: now, Confirmed: now}
+			_, err = datastore.Put(c, emailKey(c, u.ID, old), &oldEmail)
+			if err != nil {
+				return err
+			}
+		}
+		err = datastore.Delete(c, emailKey(c, u.ID, canonical))
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		account.Email = u.Email
+		account.Canonical = canonical
+		_, err = datastore.Put(c, accountKey, account)
+		if err != nil {
+			return err
+		}
+		return memcache.JSON.Set(c, &memcache.Item{
+			Key:    u.ID,
+			Object: *account,
+		})
+	}, nil)
+}
+
+func newEmailToken() (string, string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(b)
+	sum := sha256.Sum256([]byte(token))
+	return token, hex.EncodeToString(sum[:]), nil
+}
+
+// emailsHandler lists the addresses of the account.
+func (s *server) emailsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	entries, err := accountEmails(c, u)
+	if err != nil {
+		return internalError("error reading addresses", err)
+	}
+
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return internalError("error marshalling addresses", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+	return nil
+}
+
+func accountEmails(c appengine.Context, u *user.User) ([]emailEntry, error) {
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	emails := make([]KindiEmail, 0)
+	_, err := datastore.NewQuery("KindiEmail").Ancestor(accountKey).GetAll(c, &emails)
+	if err != nil {
+		return nil, err
+	}
+
+	r := []emailEntry{{Address: u.Email, Verified: true, Login: true}}
+	for _, e := range emails {
+		if !strings.EqualFold(e.Address, u.Email) {
+			r = append(r, emailEntry{Address: e.Address, Verified: e.Verified})
+		}
+	}
+	return r, nil
+}
+
+// addEmailHandler adds an address to the account and mails it a link to
+// verify it with. Adding an unverified address again sends a new link.
+func (s *server) addEmailHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	addr, err := mail.ParseAddress(r.FormValue("address"))
+	if err != nil {
+		return badRequest("bad_address", "not an email address")
+	}
+	address, err := s.canonicalEmail(addr.Address)
+	if err != nil {
+		return badRequest("bad_address", "not an email address: "+err.Error())
+	}
+	if address == s.canonical(u.Email) {
+		return conflict("address_exists", "this is your login address")
+	}
+
+	window := time.Hour
+	ok, err := rateLimit(c, "add-email-"+u.ID, s.config.Emails.HourlyLimit, window)
+	if err != nil {
+		c.Errorf("rate limit lookup failed: %v", err)
+	} else if !ok {
+		return errRateLimited("too many addresses added, try again later", window)
+	}
+
+	token, tokenHash, err := newEmailToken()
+	if err != nil {
+		return internalError("error creating token", err)
+	}
+
+	now := time.Now()
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	key := emailKey(c, u.ID, address)
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var email KindiEmail
+		err := datastore.Get(c, key, &email)
+		if err == nil && email.Verified {
+			return conflict("address_exists", "address is already verified")
+		}
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == datastore.ErrNoSuchEntity {
+			n, err := datastore.NewQuery("KindiEmail").Ancestor(accountKey).Count(c)
+			if err != nil {
+				return err
+			}
+			if n >= s.config.Emails.Max {
+				return conflict("too_many_addresses", fmt.Sprintf("an account can have at most %d addresses", s.config.Emails.Max))
+			}
+			email = KindiEmail{Address: address, Added: now}
+		}
+		email.TokenHash = tokenHash
+		email.TokenExpires = now.Add(s.config.Emails.VerifyTTL.Duration)
+		_, err = datastore.Put(c, key, &email)
+		return err
+	}, nil)
+	if err != nil {
+		return asKindiError(err, "error saving address")
+	}
+
+	link := s.absURL(r, "/account/emails/verify?"+url.Values{"address": {address}, "token": {token}}.Encode())
+	s.sendMail(c, &Message{
+		To:      []string{addr.Address},
+		Subject: "Verify your address on kindi",
+		Body: fmt.Sprintf("%s wants to publish certificates for %s on kindi.\n"+
+			"If that is you, open this link while signed in to confirm:\n\n%s\n\n"+
+			"The link is valid until %s. If you did not ask for this, ignore this mail.\n",
+			u.Email, address, link, now.Add(s.config.Emails.VerifyTTL.Duration).Format("January 2, 2006")),
+	})
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, "ok")
+	return nil
+}
+
+// verifyEmailHandler confirms an address with the token mailed to it and
+// sends the user back to the manage page.
+func (s *server) verifyEmailHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := user.Current(c)
+	if u == nil {
+		return redirectToLogin(c, w, r)
+	}
+
+	address := s.canonical(r.FormValue("address"))
+	token := r.FormValue("token")
+	if address == "" || token == "" {
+		return badRequest("bad_token", "verification link is incomplete")
+	}
+	sum := sha256.Sum256([]byte(token))
+	tokenHash := hex.EncodeToString(sum[:])
+
+	key := emailKey(c, u.ID, address)
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var email KindiEmail
+		err := datastore.Get(c, key, &email)
+		if err == datastore.ErrNoSuchEntity {
+			return notFound("no_address", "address was not added to this account")
+		}
+		if err != nil {
+			return err
+		}
+		if email.Verified {
+			return nil
+		}
+		if subtle.ConstantTimeCompare([]byte(email.TokenHash), []byte(tokenHash)) != 1 || time.Now().After(email.TokenExpires) {
+			return badRequest("bad_token", "verification link is invalid or expired")
+		}
+		email.Verified = true
+		email.Confirmed = time.Now()
+		email.TokenHash = ""
+		_, err = datastore.Put(c, key, &email)
+		return err
+	}, nil)
+	if err != nil {
+		return asKindiError(err, "error verifying address")
+	}
+
+	notifyWatchersLater.Call(c, address)
+	http.Redirect(w, r, "/manage", http.StatusFound)
+	return nil
+}
+
+// removeEmailHandler removes an address. Certificates published under
+// all addresses are pinned to the remaining ones first; removing the only
+// address a certificate is published under is refused.
+func (s *server) removeEmailHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	address := s.canonical(r.FormValue("address"))
+	if address == "" {
+		return badRequest("bad_address", "no address given")
+	}
+	if address == s.canonical(u.Email) {
+		return conflict("login_address", "the login address cannot be removed")
+	}
+
+	addresses, err := s.accountAddresses(c, u)
+	if err != nil {
+		return internalError("error reading addresses", err)
+	}
+	remaining := withoutAddress(addresses, address)
+
+	// Keys pinned to the remaining addresses are described anew.
+	priv, err := s.issuerKey(c)
+	if err != nil {
+		return internalError("error reading issuer key", err)
+	}
+
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		certs := make([]KindiCertificate, 0)
+		keys, err := datastore.NewQuery("KindiCertificate").Ancestor(accountKey).GetAll(c, &certs)
+		if err != nil {
+			return err
+		}
+
+		changed := make([]*datastore.Key, 0)
+		changedCerts := make([]KindiCertificate, 0)
+		for i := range certs {
+			cert := &certs[i]
+			primary := hasAddress(cert.PrimaryFor, address)
+			cert.PrimaryFor = withoutAddress(cert.PrimaryFor, address)
+			switch {
+			case len(cert.Addresses) == 0:
+				cert.Addresses = remaining
+			case hasAddress(cert.Addresses, address):
+				kept := withoutAddress(cert.Addresses, address)
+				if len(kept) == 0 && cert.Expires.After(time.Now()) {
+					return conflict("address_in_use", fmt.Sprintf("certificate %q is only published under %s", cert.Name, address))
+				}
+				cert.Addresses = kept
+			case !primary:
+				continue
+			}
+			changed = append(changed, keys[i])
+			changedCerts = append(changedCerts, *cert)
+		}
+
+		_, err = datastore.PutMulti(c, changed, changedCerts)
+		if err != nil {
+			return err
+		}
+
+		pubKeys := make([]KindiKey, 0)
+		keys, err = datastore.NewQuery("KindiKey").Ancestor(accountKey).GetAll(c, &pubKeys)
+		if err != nil {
+			return err
+		}
+		changed = changed[:0]
+		changedKeys := make([]KindiKey, 0)
+		for i := range pubKeys {
+			pubKey := &pubKeys[i]
+			switch {
+			case len(pubKey.Addresses) == 0:
+				pubKey.Addresses = remaining
+			case hasAddress(pubKey.Addresses, address):
+				kept := withoutAddress(pubKey.Addresses, address)
+				if len(kept) == 0 && pubKey.live(time.Now()) {
+					return conflict("address_in_use", fmt.Sprintf("key %q is only published under %s", pubKey.Name, address))
+				}
+				pubKey.Addresses = kept
+			default:
+				continue
+			}
+			err = s.describeKeyWith(c, priv, pubKey)
+			if err != nil {
+				return err
+			}
+			changed = append(changed, keys[i])
+			changedKeys = append(changedKeys, *pubKey)
+		}
+		_, err = datastore.PutMulti(c, changed, changedKeys)
+		if err != nil {
+			return err
+		}
+
+		err = datastore.Delete(c, emailKey(c, u.ID, address))
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		err = memcache.Delete(c, u.ID+"-certs")
+		if err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return asKindiError(err, "error removing address")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, "ok")
+	return nil
+}
+
+// certificateAddressesHandler chooses the verified addresses, given as
+// addresses[], the certificate id is published under.
+func (s *server) certificateAddressesHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		return newError(http.StatusBadRequest, "bad_form", "error parsing form", err)
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		return badRequest("no_certificate", "no certificate id given")
+	}
+	chosen := make([]string, 0, len(r.Form["addresses[]"]))
+	for _, a := range r.Form["addresses[]"] {
+		if a = s.canonical(a); !hasAddress(chosen, a) {
+			chosen = append(chosen, a)
+		}
+	}
+	if len(chosen) == 0 {
+		return badRequest("no_addresses", "choose at least one address")
+	}
+
+	owned, err := s.accountAddresses(c, u)
+	if err != nil {
+		return internalError("error reading addresses", err)
+	}
+	for _, a := range chosen {
+		if !hasAddress(owned, a) {
+			return badRequest("unverified_address", a+" is not a verified address of your account")
+		}
+	}
+
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	certKey := datastore.NewKey(c, "KindiCertificate", id, 0, accountKey)
+	added := make([]string, 0)
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var cert KindiCertificate
+		err := datastore.Get(c, certKey, &cert)
+		if err == datastore.ErrNoSuchEntity {
+			return notFound("no_certificate", "no such certificate")
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, a := range chosen {
+			if !cert.publishedUnder(a, owned) {
+				added = append(added, a)
+			}
+		}
+		cert.Addresses = chosen
+		for _, a := range cert.PrimaryFor {
+			if !hasAddress(chosen, a) {
+				cert.PrimaryFor = withoutAddress(cert.PrimaryFor, a)
+			}
+		}
+		_, err = datastore.Put(c, certKey, &cert)
+		if err != nil {
+			return err
+		}
+		err = memcache.Delete(c, u.ID+"-certs")
+		if err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return asKindiError(err, "error saving certificate")
+	}
+
+	for _, a := range added {
+		notifyWatchersLater.Call(c, a)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, "ok")
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPublishedUnder(t *testing.T) {
+	owned := []string{"alice@example.com", "alice@example.org"}
+
+	tests := []struct {
+		name      string
+		email     string
+		addresses []string
+		address   string
+		owned     []string
+		want      bool
+	}{
+		{"uploaded for the address", "alice@example.com", nil, "alice@example.com", nil, true},
+		// Stored addresses are canonical, so case differences are
+		// different mailboxes.
+		{"uploaded for the address in other case", "Alice@example.com", nil, "alice@example.com", nil, false},
+		{"all of the owner's addresses", "alice@example.com", nil, "alice@example.org", owned, true},
+		{"address the owner does not have", "alice@example.com", nil, "bob@example.com", owned, false},
+		// certificatesFor asks with the looked up address as the only
+		// owned one when it comes through the owner.
+		{"owner of the address", "alice@example.com", nil, "alice@example.org", []string{"alice@example.org"}, true},
+		{"chosen address", "alice@example.com", []string{"alice@example.org"}, "alice@example.org", owned, true},
+		{"chosen address in other case", "alice@example.com", []string{"Alice@example.org"}, "alice@example.org", owned, false},
+		{"address not chosen", "alice@example.com", []string{"alice@example.org"}, "alice@example.com", owned, false},
+		{"uploaded for an address not chosen", "alice@example.com", []string{"alice@example.org"}, "alice@example.com", nil, false},
+	}
+	for _, tt := range tests {
+		cert := &KindiCertificate{Email: tt.email, Addresses: tt.addresses}
+		if got := cert.publishedUnder(tt.address, tt.owned); got != tt.want {
+			t.Errorf("%s: publishedUnder(%q, %v) = %v, want %v", tt.name, tt.address, tt.owned, got, tt.want)
+		}
+		// Bare keys follow the same rules.
+		key := &KindiKey{Email: tt.email, Addresses: tt.addresses}
+		if got := key.publishedUnder(tt.address, tt.owned); got != tt.want {
+			t.Errorf("%s: key publishedUnder(%q, %v) = %v, want %v", tt.name, tt.address, tt.owned, got, tt.want)
+		}
+	}
+}
+
+func TestHasAddress(t *testing.T) {
+	addresses := []string{"alice@example.com", "Alice@example.org"}
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"alice@example.com", true},
+		{"ALICE@example.com", false},
+		{"Alice@example.org", true},
+		{"alice@example.org", false},
+		{"bob@example.com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := hasAddress(addresses, tt.address); got != tt.want {
+			t.Errorf("hasAddress(%v, %q) = %v, want %v", addresses, tt.address, got, tt.want)
+		}
+	}
+	if hasAddress(nil, "alice@example.com") {
+		t.Errorf("hasAddress(nil, alice@example.com) = true, want false")
+	}
+}
+
+func TestWithoutAddress(t *testing.T) {
+	tests := []struct {
+		addresses []string
+		address   string
+		want      string
+	}{
+		{nil, "alice@example.com", ""},
+		{[]string{"alice@example.com"}, "alice@example.com", ""},
+		{[]string{"alice@example.com", "alice@example.org"}, "alice@example.org", "alice@example.com"},
+		{[]string{"alice@example.com", "alice@example.org"}, "ALICE@example.com", "alice@example.com alice@example.org"},
+		{[]string{"alice@example.com", "alice@example.org"}, "bob@example.com", "alice@example.com alice@example.org"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(withoutAddress(tt.addresses, tt.address), " "); got != tt.want {
+			t.Errorf("withoutAddress(%v, %q) = %q, want %q", tt.addresses, tt.address, got, tt.want)
+		}
+	}
+}
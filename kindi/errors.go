@@ -0,0 +1,133 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kindiError is the error type handlers return. Status is the HTTP status
+// sent to the client, Code a stable machine readable identifier and
+// Message the text shown to the user. Err is the underlying cause, which
+// is logged but never sent. A non-zero RetryAfter is sent as the
+// Retry-After header.
+type kindiError struct {
+	Status     int
+	Code       string
+	Message    string
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *kindiError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func newError(status int, code, message string, err error) *kindiError {
+	return &kindiError{Status: status, Code: code, Message: message, Err: err}
+}
+
+func badRequest(code, message string) *kindiError {
+	return newError(http.StatusBadRequest, code, message, nil)
+}
+
+func notFound(code, message string) *kindiError {
+	return newError(http.StatusNotFound, code, message, nil)
+}
+
+func conflict(code, message string) *kindiError {
+	return newError(http.StatusConflict, code, message, nil)
+}
+
+func internalError(message string, err error) *kindiError {
+	return newError(http.StatusInternalServerError, "internal", message, err)
+}
+
+var (
+	errNoUser  = newError(http.StatusUnauthorized, "no_user", "no user", nil)
+	errNoCoins = newError(http.StatusPaymentRequired, "no_coins", "no kindi coins available", nil)
+	errCaptcha = newError(http.StatusForbidden, "captcha_failed", "recaptcha", nil)
+)
+
+// asKindiError maps err to a kindiError. Errors that are not already
+// kindiErrors become internal errors unless they are well known datastore
+// errors.
+func asKindiError(err error, message string) *kindiError {
+	if ke, ok := err.(*kindiError); ok {
+		return ke
+	}
+	switch err {
+	case datastore.ErrNoSuchEntity:
+		return newError(http.StatusNotFound, "not_found", message, err)
+	case datastore.ErrConcurrentTransaction:
+		return newError(http.StatusConflict, "concurrent_update", message, err)
+	}
+	return internalError(message, err)
+}
+
+type jsonError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// wantsJSON reports whether the client is an API caller that expects
+// JSON error bodies. The browser JS gets plain text.
+func wantsJSON(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/rpc/") {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeError(c appengine.Context, w http.ResponseWriter, r *http.Request, err error) {
+	ke := asKindiError(err, "internal error")
+
+	if ke.Status >= http.StatusInternalServerError {
+		c.Errorf("%s %s: %v", r.Method, r.URL.Path, ke)
+	} else {
+		c.Infof("%s %s: %d %s: %v", r.Method, r.URL.Path, ke.Status, ke.Code, ke)
+	}
+
+	if ke.RetryAfter > 0 {
+		secs := int64((ke.RetryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	}
+
+	if wantsJSON(r) {
+		body, jerr := json.Marshal(jsonError{Code: ke.Code, Message: ke.Message})
+		if jerr != nil {
+			c.Errorf("error marshalling error: %v", jerr)
+			http.Error(w, ke.Message, ke.Status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(ke.Status)
+		w.Write(body)
+		return
+	}
+	http.Error(w, ke.Message, ke.Status)
+}
+
+// handlerFunc is a handler that reports failures by returning an error.
+type handlerFunc func(c appengine.Context, w http.ResponseWriter, r *http.Request) error
+
+func (s *server) handle(fn handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := appengine.NewContext(r)
+		if err := fn(c, w, r); err != nil {
+			writeError(c, w, r, err)
+		}
+	}
+}
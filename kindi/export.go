@@ -0,0 +1,484 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"appengine/user"
+
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/uwedeportivo/shared/util"
+)
+
+const (
+	// Accounts with more certificates than this are exported in the
+	// background.
+	exportInlineLimit = 50
+	exportTTL         = 24 * time.Hour
+	// Datastore entities are capped at 1MB, so archives are stored in
+	// chunks below that.
+	exportChunkSize = 900 * 1024
+
+	exportPending = "pending"
+	exportReady   = "ready"
+	exportFailed  = "failed"
+)
+
+// KindiExport is an archive of everything kindi stores about an account.
+// It is a child of the KindiAccount and its bytes live in KindiExportChunk
+// children.
+type KindiExport struct {
+	ID      string
+	State   string
+	Created time.Time
+	Expires time.Time
+	Size    int
+	Chunks  int
+	Error   string `datastore:",noindex"`
+}
+
+type KindiExportChunk struct {
+	Data []byte `datastore:",noindex"`
+}
+
+type exportManifest struct {
+	Generated        time.Time           `json:"generated"`
+	Account          exportAccount       `json:"account"`
+	Certificates     []exportCertificate `json:"certificates"`
+	Keys             []exportPublicKey   `json:"keys"`
+	Orders           []exportOrder       `json:"orders"`
+	PromoRedemptions []exportOrder       `json:"promoRedemptions"`
+}
+
+type exportAccount struct {
+	Email      string       `json:"email"`
+	KindiCoins int          `json:"kindiCoins"`
+	Addresses  []emailEntry `json:"addresses"`
+}
+
+type exportCertificate struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	Processed time.Time `json:"processed"`
+	Effective time.Time `json:"effective"`
+	Expires   time.Time `json:"expires"`
+	File      string    `json:"file"`
+
+	Supersedes   string   `json:"supersedes,omitempty"`
+	SupersededBy string   `json:"supersededBy,omitempty"`
+	Addresses    []string `json:"addresses,omitempty"`
+}
+
+type exportPublicKey struct {
+	ID          string    `json:"id"`
+	Email       string    `json:"email"`
+	Name        string    `json:"name"`
+	Algorithm   string    `json:"algorithm"`
+	Processed   time.Time `json:"processed"`
+	Expires     time.Time `json:"expires"`
+	File        string    `json:"file"`
+	Description []byte    `json:"description"`
+	Signature   []byte    `json:"signature"`
+}
+
+type exportOrder struct {
+	OrderId    string    `json:"orderId"`
+	Email      string    `json:"email"`
+	Processed  time.Time `json:"processed"`
+	KindiCoins int       `json:"kindiCoins"`
+}
+
+type exportStatus struct {
+	ID          string    `json:"id"`
+	State       string    `json:"state"`
+	Expires     time.Time `json:"expires"`
+	StatusURL   string    `json:"statusUrl"`
+	DownloadURL string    `json:"downloadUrl,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+var exportLater *delay.Function
+
+func exportKey(c appengine.Context, userId, exportId string) *datastore.Key {
+	accountKey := datastore.NewKey(c, "KindiAccount", userId, 0, nil)
+	return datastore.NewKey(c, "KindiExport", exportId, 0, accountKey)
+}
+
+// buildArchive zips the account, its certificates and keys as PEM and
+// its orders together with a JSON manifest describing them.
+func (s *server) buildArchive(c appengine.Context, userId string) ([]byte, error) {
+	account, err := getAccount(c, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	accountKey := datastore.NewKey(c, "KindiAccount", userId, 0, nil)
+
+	certs := make([]KindiCertificate, 0)
+	_, err = datastore.NewQuery("KindiCertificate").Ancestor(accountKey).GetAll(c, &certs)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKeys := make([]KindiKey, 0)
+	_, err = datastore.NewQuery("KindiKey").Ancestor(accountKey).GetAll(c, &pubKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := accountEmails(c, &user.User{ID: userId, Email: account.Email})
+	if err != nil {
+		return nil, err
+	}
+
+	orders := make([]KindiOrder, 0)
+	_, err = datastore.NewQuery("KindiOrder").Ancestor(accountKey).GetAll(c, &orders)
+	if err != nil {
+		return nil, err
+	}
+	// Sorted here, as ordering an ancestor query needs a composite index.
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].Processed.Before(orders[j].Processed)
+	})
+
+	manifest := exportManifest{
+		Generated: time.Now(),
+		Account: exportAccount{
+			Email:      account.Email,
+			KindiCoins: account.KindiCoins,
+			Addresses:  addresses,
+		},
+		Certificates:     make([]exportCertificate, 0, len(certs)),
+		Keys:             make([]exportPublicKey, 0, len(pubKeys)),
+		Orders:           make([]exportOrder, 0, len(orders)),
+		PromoRedemptions: make([]exportOrder, 0),
+	}
+
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+
+	for _, cert := range certs {
+		file := fmt.Sprintf("certificates/%s.pem", cert.ID)
+		f, err := zw.Create(file)
+		if err != nil {
+			return nil, err
+		}
+		err = pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: cert.CertBytes})
+		if err != nil {
+			return nil, err
+		}
+
+		manifest.Certificates = append(manifest.Certificates, exportCertificate{
+			ID:        cert.ID,
+			Email:     cert.Email,
+			Name:      cert.Name,
+			Processed: cert.Processed,
+			Effective: cert.Effective,
+			Expires:   cert.Expires,
+			File:      file,
+
+			Supersedes:   cert.Supersedes,
+			SupersededBy: cert.SupersededBy,
+			Addresses:    cert.Addresses,
+		})
+	}
+
+	for _, key := range pubKeys {
+		file := fmt.Sprintf("keys/%s.pem", key.ID)
+		f, err := zw.Create(file)
+		if err != nil {
+			return nil, err
+		}
+		err = pem.Encode(f, &pem.Block{Type: "PUBLIC KEY", Bytes: key.KeyBytes})
+		if err != nil {
+			return nil, err
+		}
+
+		manifest.Keys = append(manifest.Keys, exportPublicKey{
+			ID:          key.ID,
+			Email:       key.Email,
+			Name:        key.Name,
+			Algorithm:   key.Algorithm,
+			Processed:   key.Processed,
+			Expires:     key.Expires,
+			File:        file,
+			Description: key.Description,
+			Signature:   key.Signature,
+		})
+	}
+
+	for _, order := range orders {
+		eo := exportOrder{
+			OrderId:    order.OrderId,
+			Email:      order.Email,
+			Processed:  order.Processed,
+			KindiCoins: order.KindiCoins,
+		}
+		if s.config.Promo.Code != "" && order.OrderId == s.config.Promo.Code {
+			manifest.PromoRedemptions = append(manifest.PromoRedemptions, eo)
+		} else {
+			manifest.Orders = append(manifest.Orders, eo)
+		}
+	}
+
+	manifestJson, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	f, err := zw.Create("manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(manifestJson)
+	if err != nil {
+		return nil, err
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// runExport builds the archive for an export and stores it. Failures are
+// recorded on the export so the user sees them.
+func (s *server) runExport(c appengine.Context, userId, exportId string) error {
+	key := exportKey(c, userId, exportId)
+
+	var export KindiExport
+	err := datastore.Get(c, key, &export)
+	if err != nil {
+		return err
+	}
+	if export.State != exportPending {
+		return nil
+	}
+
+	archive, err := s.buildArchive(c, userId)
+	if err != nil {
+		c.Errorf("error building export %s: %v", exportId, err)
+		export.State = exportFailed
+		export.Error = "error building archive"
+		_, perr := datastore.Put(c, key, &export)
+		if perr != nil {
+			return perr
+		}
+		return err
+	}
+
+	chunkKeys := make([]*datastore.Key, 0)
+	chunks := make([]*KindiExportChunk, 0)
+	for i := 0; i < len(archive); i += exportChunkSize {
+		end := i + exportChunkSize
+		if end > len(archive) {
+			end = len(archive)
+		}
+		chunkKeys = append(chunkKeys, datastore.NewKey(c, "KindiExportChunk", "", int64(len(chunks)+1), key))
+		chunks = append(chunks, &KindiExportChunk{Data: archive[i:end]})
+	}
+
+	// Chunks are written one by one to stay under the RPC size limit.
+	for i, chunk := range chunks {
+		_, err = datastore.Put(c, chunkKeys[i], chunk)
+		if err != nil {
+			return err
+		}
+	}
+
+	export.State = exportReady
+	export.Size = len(archive)
+	export.Chunks = len(chunks)
+	_, err = datastore.Put(c, key, &export)
+	return err
+}
+
+func deleteExport(c appengine.Context, key *datastore.Key) error {
+	chunkKeys, err := datastore.NewQuery("KindiExportChunk").Ancestor(key).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	for _, chunkKey := range chunkKeys {
+		err = datastore.Delete(c, chunkKey)
+		if err != nil {
+			return err
+		}
+	}
+	return datastore.Delete(c, key)
+}
+
+// purgeExports deletes expired exports nobody came back for, continuing in
+// a new job while there are more.
+func (s *server) purgeExports(c appengine.Context, params url.Values) error {
+	keys, err := datastore.NewQuery("KindiExport").Filter("Expires<", time.Now()).KeysOnly().Limit(purgeBatch).GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = deleteExport(c, key)
+		if err != nil {
+			return err
+		}
+	}
+	c.Infof("purged %d expired exports", len(keys))
+
+	if len(keys) == purgeBatch {
+		return s.enqueueJob(c, "purge-exports", "", nil, 0)
+	}
+	return nil
+}
+
+func newExportStatus(export *KindiExport) exportStatus {
+	status := exportStatus{
+		ID:        export.ID,
+		State:     export.State,
+		Expires:   export.Expires,
+		StatusURL: "/export/status?id=" + export.ID,
+		Error:     export.Error,
+	}
+	if export.State == exportReady {
+		status.DownloadURL = "/export/download?id=" + export.ID
+	}
+	return status
+}
+
+func writeExportStatus(w http.ResponseWriter, status int, export *KindiExport) error {
+	body, err := json.Marshal(newExportStatus(export))
+	if err != nil {
+		return internalError("error marshalling export status", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+	return nil
+}
+
+// exportHandler starts an export. Small accounts are archived right away,
+// large ones in a background task; either way the response tells the
+// client where to poll and download.
+func (s *server) exportHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	now := time.Now()
+	export := KindiExport{
+		ID:      util.UUID(),
+		State:   exportPending,
+		Created: now,
+		Expires: now.Add(exportTTL),
+	}
+	key := exportKey(c, u.ID, export.ID)
+
+	_, err := datastore.Put(c, key, &export)
+	if err != nil {
+		return internalError("error creating export", err)
+	}
+
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	n, err := datastore.NewQuery("KindiCertificate").Ancestor(accountKey).Count(c)
+	if err != nil {
+		return internalError("error counting certificates", err)
+	}
+
+	if n > exportInlineLimit {
+		exportLater.Call(c, u.ID, export.ID)
+	} else {
+		err = s.runExport(c, u.ID, export.ID)
+		if err != nil {
+			return internalError("error building export", err)
+		}
+		err = datastore.Get(c, key, &export)
+		if err != nil {
+			return internalError("error reading export", err)
+		}
+	}
+
+	return writeExportStatus(w, http.StatusAccepted, &export)
+}
+
+func (s *server) getExport(c appengine.Context, r *http.Request) (*datastore.Key, *KindiExport, error) {
+	u := currentUser(c, r)
+	if u == nil {
+		return nil, nil, errNoUser
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		return nil, nil, badRequest("no_export", "no export id given")
+	}
+
+	key := exportKey(c, u.ID, id)
+	var export KindiExport
+	err := datastore.Get(c, key, &export)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil, notFound("no_export", "no such export")
+	}
+	if err != nil {
+		return nil, nil, internalError("error reading export", err)
+	}
+
+	if time.Now().After(export.Expires) {
+		err = deleteExport(c, key)
+		if err != nil {
+			c.Errorf("error deleting expired export %s: %v", id, err)
+		}
+		return nil, nil, newError(http.StatusGone, "export_expired", "export link expired", nil)
+	}
+	return key, &export, nil
+}
+
+func (s *server) exportStatusHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	_, export, err := s.getExport(c, r)
+	if err != nil {
+		return err
+	}
+	return writeExportStatus(w, http.StatusOK, export)
+}
+
+func (s *server) exportDownloadHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	key, export, err := s.getExport(c, r)
+	if err != nil {
+		return err
+	}
+	if export.State != exportReady {
+		return conflict("export_not_ready", "export is not ready")
+	}
+
+	chunkKeys := make([]*datastore.Key, export.Chunks)
+	for i := range chunkKeys {
+		chunkKeys[i] = datastore.NewKey(c, "KindiExportChunk", "", int64(i+1), key)
+	}
+
+	for i, chunkKey := range chunkKeys {
+		var chunk KindiExportChunk
+		err = datastore.Get(c, chunkKey, &chunk)
+		if err != nil {
+			if i == 0 {
+				return internalError("error reading export", err)
+			}
+			c.Errorf("error reading export chunk %d of %s: %v", i+1, export.ID, err)
+			return nil
+		}
+		if i == 0 {
+			w.Header().Set("Content-Type", "application/zip")
+			w.Header().Set("Content-Disposition", "attachment; filename=\"kindi-export.zip\"")
+			w.Header().Set("Content-Length", fmt.Sprint(export.Size))
+		}
+		w.Write(chunk.Data)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Signed mails are small; anything bigger is not a registration.
+const inboundMailMax = 1 << 20
+
+// KindiInboundMail is a signed mail that was acted on, keyed by the hex
+// digest of its signature (see smimeSignature), so that the same mail
+// passed to kindi again is dropped.
+type KindiInboundMail struct {
+	From     string
+	Received time.Time
+}
+
+// inboundMailHandler receives mail sent to the app through App Engine
+// inbound mail. An S/MIME signed message whose From matches the signing
+// certificate, issued by one of mail.inboundRoots, uploads that
+// certificate for the account with that email, exactly as if it had been
+// pasted into the manage page. The signed text has to contain the
+// account's mailToken, and each signed message is acted on only once.
+func (s *server) inboundMailHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	if s.inboundRoots == nil {
+		c.Infof("ignoring inbound mail: registering by mail is turned off")
+		return nil
+	}
+
+	msg, err := mail.ReadMessage(r.Body)
+	if err != nil {
+		c.Warningf("error parsing inbound mail: %v", err)
+		return nil
+	}
+	if auto := msg.Header.Get("Auto-Submitted"); auto != "" && auto != "no" {
+		return nil
+	}
+
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		c.Warningf("inbound mail without usable From: %v", err)
+		return nil
+	}
+
+	body, err := readLimited(msg.Body, inboundMailMax)
+	if err != nil {
+		c.Infof("ignoring inbound mail from %s: %v", from.Address, err)
+		return nil
+	}
+
+	// Until the signature checks out the sender may be forged, so nothing
+	// is sent back.
+	sig, err := verifySMIME(msg, body, s.inboundRoots)
+	if err != nil {
+		c.Infof("ignoring inbound mail from %s: %v", from.Address, err)
+		return nil
+	}
+	cert := sig.signer
+	if !certHasEmail(cert, from.Address) {
+		c.Infof("ignoring inbound mail from %s: signed with a certificate for %v", from.Address, cert.EmailAddresses)
+		return nil
+	}
+
+	// The message is claimed before anything is sent back, so a replayed
+	// one does not even get a reply. Replies ask for a new signed
+	// message; the claim is only released on errors, for which App
+	// Engine delivers the mail again.
+	mailKey := datastore.NewKey(c, "KindiInboundMail", hex.EncodeToString(sig.digest[:]), 0, nil)
+	claimed, err := claimInboundMail(c, mailKey, from.Address)
+	if err != nil {
+		return internalError("error recording inbound mail", err)
+	}
+	if !claimed {
+		c.Infof("ignoring inbound mail from %s: already received", from.Address)
+		return nil
+	}
+	release := func(err error) error {
+		if derr := datastore.Delete(c, mailKey); derr != nil {
+			c.Errorf("error releasing inbound mail %s: %v", mailKey.StringID(), derr)
+		}
+		return err
+	}
+
+	reply := func(text string) {
+		s.sendMail(c, &Message{
+			To:      []string{from.Address},
+			Subject: "Re: " + msg.Header.Get("Subject"),
+			Body:    text,
+			Headers: map[string]string{
+				"In-Reply-To":    msg.Header.Get("Message-Id"),
+				"Auto-Submitted": "auto-replied",
+			},
+		})
+	}
+
+	u, err := accountByEmail(c, s.canonical(from.Address))
+	if err == datastore.ErrNoSuchEntity {
+		reply(fmt.Sprintf("There is no kindi account for %s yet. Sign in once at\n%s\n"+
+			"and send a new signed message with the registration code shown there.\n", from.Address, s.absURL(r, "/manage")))
+		return nil
+	}
+	if err != nil {
+		return release(internalError("error finding account", err))
+	}
+
+	token, err := s.mailToken(c, u.ID)
+	if err != nil {
+		return release(internalError("error creating mail token", err))
+	}
+	text, err := signedText(sig.content)
+	if err != nil || !strings.Contains(string(text), token) {
+		reply(fmt.Sprintf("Your certificate was not published: the signed message has to contain\n"+
+			"your registration code, which is shown at\n%s\n", s.absURL(r, "/manage")))
+		return nil
+	}
+
+	kindiCert, err := s.storeCertificate(c, u, strings.TrimSpace(msg.Header.Get("Subject")), cert.Raw, "")
+	if err != nil {
+		ke := asKindiError(err, "error saving certificate")
+		if ke.Status >= http.StatusInternalServerError {
+			return release(ke)
+		}
+		reply(fmt.Sprintf("Your certificate was not published: %s.\n"+
+			"To try again, send a new signed message.\n", ke.Message))
+		return nil
+	}
+
+	err = s.acceptInvites(c, u, "")
+	if err != nil {
+		c.Errorf("error accepting invites for %s: %v", u.Email, err)
+	}
+
+	reply(fmt.Sprintf("Your certificate for %s is now published on kindi as %q.\n"+
+		"It is valid until %s.\n", from.Address, kindiCert.Name, kindiCert.Expires.Format("2006-01-02")))
+	return nil
+}
+
+// claimInboundMail records the mail under key and reports false if it
+// had been recorded before.
+func claimInboundMail(c appengine.Context, key *datastore.Key, from string) (bool, error) {
+	claimed := false
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var received KindiInboundMail
+		err := datastore.Get(c, key, &received)
+		if err == nil {
+			return nil
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = datastore.Put(c, key, &KindiInboundMail{From: from, Received: time.Now()})
+		claimed = err == nil
+		return err
+	}, nil)
+	return claimed, err
+}
+
+// mailToken is the registration code the signed mails of the account
+// with userId have to contain. It ties a mail to the account it was
+// written for, so that a signed mail its owner sent somebody else cannot
+// be passed on to kindi.
+func (s *server) mailToken(c appengine.Context, userId string) (string, error) {
+	key, err := s.secrets.Secret(c, s.config.CSRF.SecretName)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("inbound-mail|" + userId))
+	return "kindi-" + hex.EncodeToString(mac.Sum(nil)[:10]), nil
+}
+
+// accountByEmail finds the account whose login email or verified address
+// is the canonical email.
+func accountByEmail(c appengine.Context, email string) (*user.User, error) {
+	owners, err := addressOwners(c, email)
+	if err != nil {
+		return nil, err
+	}
+	switch len(owners) {
+	case 0:
+		return nil, datastore.ErrNoSuchEntity
+	case 1:
+		account, err := getAccount(c, owners[0])
+		if err != nil {
+			return nil, err
+		}
+		return &user.User{ID: owners[0], Email: account.Email}, nil
+	}
+	return nil, fmt.Errorf("more than one account for %s", email)
+}
+
+// readLimited reads at most n bytes of r and fails if there is more.
+func readLimited(r io.Reader, n int64) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, n+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > n {
+		return nil, errors.New("message too large")
+	}
+	return b, nil
+}
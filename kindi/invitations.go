@@ -0,0 +1,268 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/uwedeportivo/shared/util"
+)
+
+const (
+	inviteSent     = "sent"
+	inviteOpened   = "opened"
+	inviteAccepted = "accepted"
+	inviteExpired  = "expired"
+)
+
+// KindiInvite tracks an invitation to upload a certificate. It is a child
+// of the inviter's KindiAccount, keyed by Token. Recipient is canonical.
+type KindiInvite struct {
+	Token        string
+	InviterEmail string
+	Recipient    string
+	Note         string `datastore:",noindex"`
+	State        string
+	Sent         time.Time
+	Opened       time.Time
+	Accepted     time.Time
+	Expires      time.Time
+}
+
+// Outstanding reports whether the invite still waits for the recipient.
+func (inv *KindiInvite) Outstanding() bool {
+	return inv.State == inviteSent || inv.State == inviteOpened
+}
+
+func inviteKey(c appengine.Context, inviterId, token string) *datastore.Key {
+	accountKey := datastore.NewKey(c, "KindiAccount", inviterId, 0, nil)
+	return datastore.NewKey(c, "KindiInvite", token, 0, accountKey)
+}
+
+// inviteRef is the signed "<inviter id>.<token>.<mac>" reference carried
+// by invite links.
+func (s *server) inviteRef(c appengine.Context, inviterId, token string) (string, error) {
+	key, err := s.secrets.Secret(c, s.config.Invites.SecretName)
+	if err != nil {
+		return "", err
+	}
+	return inviterId + "." + token + "." + inviteMAC(key, inviterId, token), nil
+}
+
+func inviteMAC(key, inviterId, token string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(inviterId + "." + token))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseInviteRef checks the signature on ref and returns the key of the
+// invite it refers to.
+func (s *server) parseInviteRef(c appengine.Context, ref string) (*datastore.Key, error) {
+	parts := strings.SplitN(ref, ".", 3)
+	if len(parts) != 3 {
+		return nil, badRequest("bad_invite", "invalid invite link")
+	}
+
+	key, err := s.secrets.Secret(c, s.config.Invites.SecretName)
+	if err != nil {
+		return nil, internalError("error reading invite key", err)
+	}
+	expected := inviteMAC(key, parts[0], parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return nil, badRequest("bad_invite", "invalid invite link")
+	}
+	return inviteKey(c, parts[0], parts[1]), nil
+}
+
+func (s *server) createInvite(c appengine.Context, inviter *user.User, recipient, note string) (*KindiInvite, error) {
+	now := time.Now()
+	invite := &KindiInvite{
+		Token:        util.UUID(),
+		InviterEmail: inviter.Email,
+		Recipient:    s.canonical(recipient),
+		Note:         note,
+		State:        inviteSent,
+		Sent:         now,
+		Expires:      now.Add(s.config.Invites.TTL.Duration),
+	}
+	_, err := datastore.Put(c, inviteKey(c, inviter.ID, invite.Token), invite)
+	if err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// updateInvite moves the invite at key to state, unless it is no longer
+// outstanding. Invites past their expiry move to expired instead. It
+// returns the invite as stored and whether it moved to state.
+func updateInvite(c appengine.Context, key *datastore.Key, state string) (*KindiInvite, bool, error) {
+	var invite KindiInvite
+	changed := false
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		changed = false
+		err := datastore.Get(c, key, &invite)
+		if err != nil {
+			return err
+		}
+		if !invite.Outstanding() || invite.State == state {
+			return nil
+		}
+
+		now := time.Now()
+		if now.After(invite.Expires) {
+			invite.State = inviteExpired
+		} else {
+			invite.State = state
+			changed = true
+			switch state {
+			case inviteOpened:
+				invite.Opened = now
+			case inviteAccepted:
+				invite.Accepted = now
+			}
+		}
+		_, err = datastore.Put(c, key, &invite)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	return &invite, changed, nil
+}
+
+// acceptInvites marks the invites for u as accepted once u uploaded a
+// certificate and lets the inviters know. Invites are found through the
+// signed ref the upload came in with and through u's verified addresses.
+func (s *server) acceptInvites(c appengine.Context, u *user.User, ref string) error {
+	keys := make([]*datastore.Key, 0)
+
+	addresses, err := s.accountAddresses(c, u)
+	if err != nil {
+		return err
+	}
+
+	if ref != "" {
+		key, err := s.parseInviteRef(c, ref)
+		if err != nil {
+			c.Infof("ignoring invite ref %q: %v", ref, err)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, address := range addresses {
+		for _, state := range []string{inviteSent, inviteOpened} {
+			q := datastore.NewQuery("KindiInvite").Filter("Recipient=", address).Filter("State=", state).KeysOnly()
+			found, err := q.GetAll(c, nil)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, found...)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if seen[key.String()] {
+			continue
+		}
+		seen[key.String()] = true
+
+		invite, accepted, err := updateInvite(c, key, inviteAccepted)
+		if err == datastore.ErrNoSuchEntity {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !accepted {
+			continue
+		}
+
+		s.sendMail(c, &Message{
+			ReplyTo: u.Email,
+			To:      []string{invite.InviterEmail},
+			Subject: "Your kindi invitation was accepted",
+			Body: fmt.Sprintf("%s accepted your invitation and uploaded a certificate to kindi.\n"+
+				"You can now send them encrypted files.\n", u.Email),
+		})
+	}
+	return nil
+}
+
+func getUserInvites(c appengine.Context, userId string) ([]KindiInvite, error) {
+	accountKey := datastore.NewKey(c, "KindiAccount", userId, 0, nil)
+
+	invites := make([]KindiInvite, 0)
+	_, err := datastore.NewQuery("KindiInvite").Ancestor(accountKey).GetAll(c, &invites)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i := range invites {
+		if invites[i].Outstanding() && now.After(invites[i].Expires) {
+			invites[i].State = inviteExpired
+		}
+	}
+	return invites, nil
+}
+
+// acceptHandler is where invite links land. It records that the invite
+// was opened and sends the recipient on to the upload page.
+func (s *server) acceptHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := user.Current(c)
+	if u == nil {
+		return redirectToLogin(c, w, r)
+	}
+
+	ref := r.FormValue("i")
+	key, err := s.parseInviteRef(c, ref)
+	if err != nil {
+		return err
+	}
+
+	invite, _, err := updateInvite(c, key, inviteOpened)
+	if err == datastore.ErrNoSuchEntity {
+		return notFound("no_invite", "no such invite")
+	}
+	if err != nil {
+		return internalError("error updating invite", err)
+	}
+	if invite.State == inviteExpired {
+		return newError(http.StatusGone, "invite_expired", "invite expired", nil)
+	}
+
+	http.Redirect(w, r, "/manage?invite="+url.QueryEscape(ref), http.StatusFound)
+	return nil
+}
+
+// baseURL is the configured base URL for links, or the host the request
+// came in on.
+func (s *server) baseURL(r *http.Request) string {
+	base := s.config.BaseURL
+	if base == "" {
+		scheme := "https"
+		if r.TLS == nil && appengine.IsDevAppServer() {
+			scheme = "http"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return strings.TrimRight(base, "/")
+}
+
+// absURL turns path into an absolute URL on the base URL.
+func (s *server) absURL(r *http.Request, path string) string {
+	return s.baseURL(r) + path
+}
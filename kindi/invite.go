@@ -3,138 +3,198 @@
 package kindi
 
 import (
-	"bytes"
-	"fmt"
 	"appengine"
-	"appengine/mail"
 	"appengine/user"
-	"appengine/urlfetch"
 
-	"io/ioutil"
+	"fmt"
 	"html/template"
 	"net/http"
+	"net/mail"
 	"net/url"
-	"strings"
+	"time"
 )
 
-const (
-	recaptchaPrivateKey = "........."
-	captchaURL = "http://www.google.com/recaptcha/api/verify"
-)
+// Invite rate limits count per day.
+const inviteRateWindow = 24 * time.Hour
 
 var inviteTmpl *template.Template
-var mailTmpl *template.Template
+var invitesTableTmpl *template.Template
 
 func init() {
 	root := template.New("root")
 	root = root.Funcs(template.FuncMap{"formatTime": FormatTime})
-	root = template.Must(root.ParseFiles("tmpl/invite.html", "tmpl/payments.html"))
+	root = template.Must(root.ParseFiles("tmpl/invite.html", "tmpl/invites_table.html", "tmpl/payments.html"))
 	inviteTmpl = root.Lookup("invite.html")
-	mailTmpl = template.Must(template.ParseFiles("tmpl/mail.html"))
+	invitesTableTmpl = inviteTmpl.Lookup("invites_table.html")
 }
 
 type InviteTmplData struct {
-	Username     string
-	KindiCoins   int
+	Username        string
+	KindiCoins      int
+	CSRFToken       string
+	CaptchaProvider string
+	CaptchaSiteKey  string
+	Invites         []KindiInvite
 }
 
 type MailTmplData struct {
-	Recipient string
-	Sender string
-	Note string
+	Recipient   string
+	Sender      string
+	Note        string
+	Link        string
+	Unsubscribe string
 }
 
-func inviteHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	u := user.Current(c)
+func (s *server) inviteHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
 	if u == nil {
-		c.Errorf("error sending email: no user")
-		http.Error(w, "no user", http.StatusInternalServerError)
-		return
+		return errNoUser
 	}
 
 	recipient := r.FormValue("recipient")
 	if recipient == "" {
-		c.Errorf("error sending email: no recipient")
-		http.Error(w, "no recipient", http.StatusInternalServerError)
-		return	
+		return badRequest("no_recipient", "no recipient")
 	}
 
-	captchaValues := url.Values{}
-	captchaValues.Set("privatekey", recaptchaPrivateKey)
-	captchaValues.Set("remoteip", r.RemoteAddr)
-	captchaValues.Set("challenge", r.FormValue("recaptcha_challenge_field"))
-	captchaValues.Set("response", r.FormValue("recaptcha_response_field"))
+	human, err := s.captcha.Verify(c, r)
+	if err != nil {
+		return newError(http.StatusServiceUnavailable, "captcha_unavailable", "error verifying captcha", err)
+	}
+	if !human {
+		return errCaptcha
+	}
 
-	captchaClient := urlfetch.Client(c)
-	captchaResponse, err := captchaClient.PostForm(captchaURL, captchaValues)
+	err = s.sendInvite(c, u, recipient, r.FormValue("note"), s.inviteLocale(r), s.baseURL(r))
+	if err != nil {
+		return err
+	}
 
-	defer captchaResponse.Body.Close()
-	captchaBody, err := ioutil.ReadAll(captchaResponse.Body)
-	captchaLines := strings.Split(string(captchaBody), "\n")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, "ok")
+	return nil
+}
 
-	if len(captchaLines) > 0 && captchaLines[0] == "true" {
-		mailData := MailTmplData{
-			Recipient: recipient,
-			Sender: u.Email,
-			Note: r.FormValue("note"),
-		}
+// sendInvite checks recipient against the suppression list and the
+// invite limits, records the invite and mails it in locale with links
+// on base. Suppressions and limits go by the canonical address, so that
+// other spellings of it are held to them too.
+func (s *server) sendInvite(c appengine.Context, inviter *user.User, recipient, note, locale, base string) error {
+	addr, err := mail.ParseAddress(recipient)
+	if err != nil {
+		return badRequest("bad_recipient", "recipient is not an email address")
+	}
+	recipient = addr.Address
+	canonical, err := s.canonicalEmail(recipient)
+	if err != nil {
+		return badRequest("bad_recipient", "recipient is not an email address: "+err.Error())
+	}
 
-		buf := new(bytes.Buffer)
-		err = mailTmpl.Execute(buf, mailData)
-		if err != nil {
-			c.Errorf("error composing email: %v", err)
-		    http.Error(w, "error composing email", http.StatusInternalServerError)
-			return
-		}
+	suppressed, err := isSuppressed(c, canonical)
+	if err != nil {
+		return internalError("error checking suppression list", err)
+	}
+	if suppressed {
+		return conflict("recipient_suppressed", "recipient does not accept invites")
+	}
 
-		msg := &mail.Message{
-	        Sender:  u.Email,
-	        To:      []string{recipient, u.Email},
-	        Subject: "Upload certificate to kindi",
-	        Body:    buf.String(),
+	limits := []struct {
+		key   string
+		limit int
+	}{
+		{"invite-sender-" + inviter.ID, s.config.Invites.SenderLimit},
+		{"invite-recipient-" + canonical, s.config.Invites.RecipientLimit},
+		{"invite-global", s.config.Invites.DailyCap},
+	}
+	for _, l := range limits {
+		ok, err := rateLimit(c, l.key, l.limit, inviteRateWindow)
+		if err != nil {
+			return internalError("error checking invite limits", err)
 		}
-		if err := mail.Send(c, msg); err != nil {
-			c.Errorf("error sending email: %v", err)
-		    http.Error(w, "error sending email", http.StatusInternalServerError)
-			return
+		if !ok {
+			return errRateLimited("too many invites, try again tomorrow", inviteRateWindow)
 		}
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		fmt.Fprint(w, "ok")
-		return
 	}
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	fmt.Fprint(w, "recaptcha")
+
+	invite, err := s.createInvite(c, inviter, recipient, note)
+	if err != nil {
+		return internalError("error saving invite", err)
+	}
+
+	ref, err := s.inviteRef(c, inviter.ID, invite.Token)
+	if err != nil {
+		return internalError("error signing invite", err)
+	}
+
+	unsubscribe, err := s.unsubscribeURL(c, base, recipient)
+	if err != nil {
+		return internalError("error signing unsubscribe link", err)
+	}
+
+	mailData := MailTmplData{
+		Recipient:   recipient,
+		Sender:      inviter.Email,
+		Note:        note,
+		Link:        base + "/accept?i=" + url.QueryEscape(ref),
+		Unsubscribe: unsubscribe,
+	}
+
+	rendered, err := s.mailTmpls.renderInvite(locale, mailData)
+	if err != nil {
+		return internalError("error composing email", err)
+	}
+
+	s.sendMail(c, &Message{
+		ReplyTo:  inviter.Email,
+		To:       []string{recipient},
+		Cc:       []string{inviter.Email},
+		Subject:  rendered.Subject,
+		Body:     rendered.Text,
+		HTMLBody: rendered.HTML,
+		Headers: map[string]string{
+			"List-Unsubscribe": "<" + unsubscribe + ">",
+		},
+	})
+	return nil
 }
 
-func lookupHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+func (s *server) lookupHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
 	u := user.Current(c)
 	if u == nil {
-		url, err := user.LoginURL(c, r.URL.String())
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Location", url)
-		w.WriteHeader(http.StatusFound)
-		return
+		return redirectToLogin(c, w, r)
+	}
+
+	account, err := s.getOrCreateAccount(c, u)
+	if err != nil {
+		return asKindiError(err, "error retrieving account")
+	}
+
+	invites, err := getUserInvites(c, u.ID)
+	if err != nil {
+		return internalError("error retrieving invites", err)
 	}
 
-	account, err := getOrCreateAccount(c, u)
+	csrfToken, err := s.csrfToken(c, u.ID)
 	if err != nil {
-		c.Errorf("error retrieving account: %v", err)
-		http.Error(w, "error retrieving account", http.StatusInternalServerError)
-		return
+		return internalError("error creating csrf token", err)
 	}
 
 	data := InviteTmplData{
-		Username:     u.String(),
-		KindiCoins:   account.KindiCoins,
+		Username:   u.String(),
+		KindiCoins: account.KindiCoins,
+		CSRFToken:  csrfToken,
+
+		CaptchaProvider: s.config.Captcha.Provider,
+		CaptchaSiteKey:  s.config.Captcha.SiteKey,
+		Invites:         invites,
 	}
 
-	err = inviteTmpl.Execute(w, data)
+	if r.FormValue("tableOnly") == "" {
+		err = inviteTmpl.Execute(w, data)
+	} else {
+		err = invitesTableTmpl.Execute(w, data)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		return internalError("error rendering page", err)
 	}
+	return nil
 }
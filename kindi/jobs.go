@@ -0,0 +1,283 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/uwedeportivo/shared/util"
+)
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+
+	// Finished jobs are kept this long so repeated enqueues with the
+	// same idempotency key stay no-ops.
+	jobRetention = 30 * 24 * time.Hour
+
+	// The in-process runner holds up a request while it backs off, so it
+	// never waits longer than this between attempts.
+	inProcessMaxBackoff = 5 * time.Second
+)
+
+// KindiJob is one run of a background job, keyed by its idempotency key.
+type KindiJob struct {
+	Name      string
+	Params    string `datastore:",noindex"`
+	State     string
+	Attempts  int
+	LastError string `datastore:",noindex"`
+	Created   time.Time
+	Updated   time.Time
+}
+
+// jobFunc does the work of one kind of job. Returning an error retries
+// the job with backoff.
+type jobFunc func(c appengine.Context, params url.Values) error
+
+// JobRunner gets enqueued jobs run, calling back into runJob with the
+// job's key.
+type JobRunner interface {
+	Run(c appengine.Context, key string, delay time.Duration) error
+}
+
+// scheduledJobs are the jobs cron.yaml starts through /jobs/cron/<name>,
+// with how often cron runs them. Cron calls within one period share an
+// idempotency key, so a repeated call does not run the job twice.
+var scheduledJobs = map[string]time.Duration{
+	"purge-certificates":  24 * time.Hour,
+	"promo-counters":      24 * time.Hour,
+	"retry-mail":          10 * time.Minute,
+	"expiry-reminders":    24 * time.Hour,
+	"retire-certificates": time.Hour,
+	"rescan-keys":         24 * time.Hour,
+	"purge-jobs":          24 * time.Hour,
+	"purge-exports":       24 * time.Hour,
+	"canonicalize-emails": 24 * time.Hour,
+}
+
+func newJobRunner(cfg JobsConfig, run func(c appengine.Context, key string) error) JobRunner {
+	if cfg.Runner == "inprocess" {
+		return &inProcessRunner{cfg: cfg, run: run}
+	}
+	return &taskqueueRunner{cfg: cfg}
+}
+
+// taskqueueRunner posts jobs to /jobs/run on an App Engine push queue,
+// which retries them with the configured backoff while they fail.
+type taskqueueRunner struct {
+	cfg JobsConfig
+}
+
+func (q *taskqueueRunner) Run(c appengine.Context, key string, delay time.Duration) error {
+	t := taskqueue.NewPOSTTask("/jobs/run", url.Values{"key": {key}})
+	t.Delay = delay
+	t.RetryOptions = &taskqueue.RetryOptions{
+		MinBackoff: q.cfg.MinBackoff.Duration,
+		MaxBackoff: q.cfg.MaxBackoff.Duration,
+	}
+	_, err := taskqueue.Add(c, t, q.cfg.Queue)
+	return err
+}
+
+// inProcessRunner runs jobs right away in the calling request, retrying
+// inline. Meant for the dev server and deployments without a task queue.
+type inProcessRunner struct {
+	cfg JobsConfig
+	run func(c appengine.Context, key string) error
+}
+
+func (q *inProcessRunner) Run(c appengine.Context, key string, delay time.Duration) error {
+	if delay > 0 {
+		c.Infof("running job %s now instead of in %v", key, delay)
+	}
+	for attempt := 1; ; attempt++ {
+		err := q.run(c, key)
+		if err == nil {
+			return nil
+		}
+		// runJob only keeps failing until the job is out of attempts.
+		wait := backoff(q.cfg, attempt)
+		if wait > inProcessMaxBackoff {
+			wait = inProcessMaxBackoff
+		}
+		c.Warningf("job %s failed, retrying in %v: %v", key, wait, err)
+		time.Sleep(wait)
+	}
+}
+
+// backoff is the wait after the given failed attempt.
+func backoff(cfg JobsConfig, attempt int) time.Duration {
+	d := cfg.MinBackoff.Duration
+	for i := 1; i < attempt && d < cfg.MaxBackoff.Duration; i++ {
+		d *= 2
+	}
+	if d > cfg.MaxBackoff.Duration {
+		d = cfg.MaxBackoff.Duration
+	}
+	return d
+}
+
+// enqueueJob runs job name with params in the background after delay. If
+// a job with the same non-empty key was enqueued before, nothing happens.
+func (s *server) enqueueJob(c appengine.Context, name, key string, params url.Values, delay time.Duration) error {
+	if _, ok := s.jobFuncs[name]; !ok {
+		return fmt.Errorf("no job named %q", name)
+	}
+	if key == "" {
+		key = name + "-" + util.UUID()
+	}
+
+	now := time.Now()
+	jobKey := datastore.NewKey(c, "KindiJob", key, 0, nil)
+	added := false
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var job KindiJob
+		err := datastore.Get(c, jobKey, &job)
+		if err == nil {
+			return nil
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		job = KindiJob{
+			Name:    name,
+			Params:  params.Encode(),
+			State:   jobQueued,
+			Created: now,
+			Updated: now,
+		}
+		_, err = datastore.Put(c, jobKey, &job)
+		added = err == nil
+		return err
+	}, nil)
+	if err != nil || !added {
+		return err
+	}
+	err = s.jobs.Run(c, key, delay)
+	if err != nil {
+		// Nothing will run the job, so free the key for another try.
+		if derr := datastore.Delete(c, jobKey); derr != nil {
+			c.Errorf("error deleting job %s that could not be run: %v", key, derr)
+		}
+	}
+	return err
+}
+
+// runJob makes one attempt at the job stored under key. It returns an
+// error only if the job failed and has attempts left.
+func (s *server) runJob(c appengine.Context, key string) error {
+	jobKey := datastore.NewKey(c, "KindiJob", key, 0, nil)
+
+	var job KindiJob
+	err := datastore.Get(c, jobKey, &job)
+	if err == datastore.ErrNoSuchEntity {
+		c.Warningf("no job %s", key)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if job.State == jobDone || job.State == jobFailed {
+		return nil
+	}
+
+	fn, ok := s.jobFuncs[job.Name]
+	params, perr := url.ParseQuery(job.Params)
+	if !ok || perr != nil {
+		c.Errorf("job %s: cannot run %q", key, job.Name)
+		job.State = jobFailed
+		job.Updated = time.Now()
+		_, err = datastore.Put(c, jobKey, &job)
+		return err
+	}
+
+	job.Attempts++
+	job.State = jobRunning
+	job.Updated = time.Now()
+	_, err = datastore.Put(c, jobKey, &job)
+	if err != nil {
+		return err
+	}
+
+	runErr := fn(c, params)
+
+	job.Updated = time.Now()
+	switch {
+	case runErr == nil:
+		job.State = jobDone
+		job.LastError = ""
+	case job.Attempts >= s.config.Jobs.MaxAttempts:
+		c.Errorf("job %s gave up after %d attempts: %v", key, job.Attempts, runErr)
+		job.State = jobFailed
+		job.LastError = runErr.Error()
+		runErr = nil
+	default:
+		job.State = jobQueued
+		job.LastError = runErr.Error()
+	}
+	_, err = datastore.Put(c, jobKey, &job)
+	if err != nil {
+		return err
+	}
+	return runErr
+}
+
+// jobRunHandler is where the task queue delivers jobs.
+func (s *server) jobRunHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	key := r.FormValue("key")
+	if key == "" {
+		return badRequest("no_job", "no job key given")
+	}
+	err := s.runJob(c, key)
+	if err != nil {
+		return internalError("job failed", err)
+	}
+	return nil
+}
+
+// jobCronHandler starts the scheduled job named by the last path element.
+func (s *server) jobCronHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	name := strings.TrimPrefix(r.URL.Path, "/jobs/cron/")
+	every, ok := scheduledJobs[name]
+	if !ok {
+		return notFound("no_job", "no such scheduled job")
+	}
+
+	key := fmt.Sprintf("%s-%d", name, time.Now().Truncate(every).Unix())
+	err := s.enqueueJob(c, name, key, nil, 0)
+	if err != nil {
+		return internalError("error starting job", err)
+	}
+	return nil
+}
+
+// purgeJobs drops job records that finished long enough ago. Queued and
+// running ones are kept however old, as runJob drops a job whose record
+// is gone.
+func (s *server) purgeJobs(c appengine.Context, params url.Values) error {
+	cutoff := time.Now().Add(-jobRetention)
+	jobs := make([]KindiJob, 0)
+	keys, err := datastore.NewQuery("KindiJob").Filter("Updated<", cutoff).GetAll(c, &jobs)
+	if err != nil {
+		return err
+	}
+	finished := make([]*datastore.Key, 0, len(keys))
+	for i, job := range jobs {
+		if job.State == jobDone || job.State == jobFailed {
+			finished = append(finished, keys[i])
+		}
+	}
+	return deleteKeys(c, finished)
+}
@@ -0,0 +1,462 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/uwedeportivo/shared/util"
+)
+
+// keyChecker rejects public keys that are too small or known to be
+// breakable.
+type keyChecker struct {
+	minRSABits int
+	minECBits  int
+	// blocked holds the blocklist fingerprints, see KeysConfig.
+	blocked map[string]bool
+}
+
+func newKeyChecker(cfg KeysConfig) (*keyChecker, error) {
+	k := &keyChecker{
+		minRSABits: cfg.MinRSABits,
+		minECBits:  cfg.MinECBits,
+		blocked:    make(map[string]bool),
+	}
+	if cfg.Blocklist == "" {
+		return k, nil
+	}
+
+	f, err := os.Open(cfg.Blocklist)
+	if err != nil {
+		return nil, fmt.Errorf("key blocklist: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := hex.DecodeString(line); err != nil || (len(line) != 64 && len(line) != 40 && len(line) != 20) {
+			return nil, fmt.Errorf("key blocklist %s:%d: not a fingerprint", cfg.Blocklist, n)
+		}
+		k.blocked[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("key blocklist: %v", err)
+	}
+	return k, nil
+}
+
+// check returns the problems with cert's public key.
+func (k *keyChecker) check(cert *x509.Certificate) []lintProblem {
+	problems := make([]lintProblem, 0)
+	add := func(code, format string, args ...interface{}) {
+		problems = append(problems, lintProblem{code, severityError, fmt.Sprintf(format, args...)})
+	}
+
+	if k.isBlocked(cert) {
+		add("compromised_key", "key is on the list of known compromised keys")
+	}
+
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if bits := key.N.BitLen(); bits < k.minRSABits {
+			add("weak_key", "RSA key has %d bits, at least %d are needed", bits, k.minRSABits)
+		}
+		if isROCA(key.N) {
+			add("roca_key", "RSA key was made by a chip with the ROCA flaw (CVE-2017-15361) and can be factored")
+		}
+		if p := smallFactor(key.N); p != 0 {
+			add("weak_key", "RSA modulus is divisible by %d", p)
+		}
+	case *ecdsa.PublicKey:
+		if bits := key.Curve.Params().BitSize; bits < k.minECBits {
+			add("weak_key", "EC key on %s has %d bits, at least %d are needed", key.Curve.Params().Name, bits, k.minECBits)
+		}
+	}
+	return problems
+}
+
+// isBlocked looks cert's key up by the SHA-256 of its SubjectPublicKeyInfo
+// and, for RSA keys, by the fingerprints of Debian's openssl-blacklist:
+// the SHA-1 of "Modulus=<upper case hex>\n", in full or its last 20 hex
+// digits.
+func (k *keyChecker) isBlocked(cert *x509.Certificate) bool {
+	if len(k.blocked) == 0 {
+		return false
+	}
+	if k.spkiBlocked(cert.RawSubjectPublicKeyInfo) {
+		return true
+	}
+	if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+		sum := sha1.Sum([]byte("Modulus=" + strings.ToUpper(key.N.Text(16)) + "\n"))
+		h := hex.EncodeToString(sum[:])
+		return k.blocked[h] || k.blocked[h[20:]]
+	}
+	return false
+}
+
+// spkiBlocked looks the DER SubjectPublicKeyInfo up by its SHA-256.
+func (k *keyChecker) spkiBlocked(spki []byte) bool {
+	sum := sha256.Sum256(spki)
+	return k.blocked[hex.EncodeToString(sum[:])]
+}
+
+// rocaPrimes are the small primes of the ROCA fingerprint test. Infineon
+// generated primes of the form k*M + (65537^a mod M), so a vulnerable
+// modulus lies in the subgroup generated by 65537 modulo each of them.
+var rocaPrimes = []int64{3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53, 59, 61,
+	67, 71, 73, 79, 83, 89, 97, 101, 103, 107, 109, 113, 127, 131, 137, 139, 149, 151, 157, 163, 167}
+
+var rocaSubgroups = func() []map[int64]bool {
+	r := make([]map[int64]bool, len(rocaPrimes))
+	for i, p := range rocaPrimes {
+		r[i] = make(map[int64]bool)
+		for g := int64(1); !r[i][g]; g = g * 65537 % p {
+			r[i][g] = true
+		}
+	}
+	return r
+}()
+
+// isROCA reports whether n has the fingerprint of an Infineon ROCA key.
+func isROCA(n *big.Int) bool {
+	m := new(big.Int)
+	for i, p := range rocaPrimes {
+		if !rocaSubgroups[i][m.Mod(n, big.NewInt(p)).Int64()] {
+			return false
+		}
+	}
+	return true
+}
+
+// smallFactor returns a prime below 1000 dividing n, or 0.
+func smallFactor(n *big.Int) int64 {
+	m := new(big.Int)
+	for p := int64(2); p < 1000; p++ {
+		if big.NewInt(p).ProbablyPrime(0) && m.Mod(n, big.NewInt(p)).Sign() == 0 {
+			return p
+		}
+	}
+	return 0
+}
+
+// sharedFactors returns the indexes of the moduli that share a prime with
+// another one, using Bernstein's batch GCD: a product tree of all moduli
+// and a remainder tree down to each of them.
+func sharedFactors(moduli []*big.Int) map[int]bool {
+	r := make(map[int]bool)
+	if len(moduli) < 2 {
+		return r
+	}
+
+	tree := [][]*big.Int{moduli}
+	for level := moduli; len(level) > 1; {
+		next := make([]*big.Int, (len(level)+1)/2)
+		for i := range next {
+			if 2*i+1 < len(level) {
+				next[i] = new(big.Int).Mul(level[2*i], level[2*i+1])
+			} else {
+				next[i] = level[2*i]
+			}
+		}
+		tree = append(tree, next)
+		level = next
+	}
+
+	rems := tree[len(tree)-1]
+	for l := len(tree) - 2; l >= 0; l-- {
+		level := tree[l]
+		next := make([]*big.Int, len(level))
+		for i, n := range level {
+			sq := new(big.Int).Mul(n, n)
+			next[i] = new(big.Int).Mod(rems[i/2], sq)
+		}
+		rems = next
+	}
+
+	one := big.NewInt(1)
+	for i, n := range moduli {
+		q := new(big.Int).Div(rems[i], n)
+		if new(big.Int).GCD(nil, nil, q, n).Cmp(one) != 0 {
+			r[i] = true
+		}
+	}
+	return r
+}
+
+// Certificates or keys checked per rescan-keys run.
+const rescanBatch = 200
+
+const sharedFactorReason = "RSA modulus shares a prime factor with another published key and can be factored"
+
+// KindiRescanModuli holds the RSA moduli one rescan-keys batch came
+// across, so that the last run can look for shared factors without
+// loading every certificate. Its parent is a KindiRescan keyed by the ID
+// of the rescan, which is never stored.
+type KindiRescanModuli struct {
+	// Moduli is the JSON list of rescanModulus.
+	Moduli []byte `datastore:",noindex"`
+}
+
+// rescanModulus is the modulus of the certificate with the encoded
+// datastore key Key.
+type rescanModulus struct {
+	Key string   `json:"key"`
+	N   *big.Int `json:"n"`
+}
+
+// rescanKeys runs the key checks, which may have gained rules or
+// blocklist entries since upload, over every published certificate and
+// bare key and looks for RSA moduli sharing a factor. Failing
+// certificates and keys are flagged, which takes them out of lookups,
+// and their owners are told once. Like canonicalizeEmails it works one
+// batch at a time, certificates first and then keys, continuing in a new
+// job with the kind and cursor it got to. The moduli are kept for a last
+// run that compares them all.
+func (s *server) rescanKeys(c appengine.Context, params url.Values) error {
+	run := params.Get("run")
+	if run == "" {
+		run = util.UUID()
+	}
+	runKey := datastore.NewKey(c, "KindiRescan", run, 0, nil)
+
+	kind := params.Get("kind")
+	switch kind {
+	case "":
+		kind = "KindiCertificate"
+	case "KindiCertificate", "KindiKey":
+	case "moduli":
+		return s.rescanModuli(c, runKey)
+	default:
+		return fmt.Errorf("cannot rescan %s", kind)
+	}
+
+	q := datastore.NewQuery(kind).Filter("Expires>", time.Now()).Limit(rescanBatch)
+	if cursor := params.Get("cursor"); cursor != "" {
+		start, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return err
+		}
+		q = q.Start(start)
+	}
+
+	n := 0
+	moduli := make([]rescanModulus, 0)
+	it := q.Run(c)
+	for {
+		var cert KindiCertificate
+		var pubKey KindiKey
+		var key *datastore.Key
+		var err error
+		if kind == "KindiCertificate" {
+			key, err = it.Next(&cert)
+		} else {
+			key, err = it.Next(&pubKey)
+		}
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		n++
+
+		if kind == "KindiCertificate" {
+			err = s.rescanCertificate(c, key, &cert, &moduli)
+		} else if pubKey.Flagged == "" && s.keys.spkiBlocked(pubKey.KeyBytes) {
+			err = s.flagKey(c, key, "key is on the list of known compromised keys")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(moduli) > 0 {
+		data, err := json.Marshal(moduli)
+		if err != nil {
+			return err
+		}
+		_, err = datastore.Put(c, datastore.NewIncompleteKey(c, "KindiRescanModuli", runKey), &KindiRescanModuli{Moduli: data})
+		if err != nil {
+			return err
+		}
+	}
+
+	next := url.Values{"run": {run}, "kind": {kind}}
+	if n == rescanBatch {
+		cursor, err := it.Cursor()
+		if err != nil {
+			return err
+		}
+		next.Set("cursor", cursor.String())
+	} else if kind == "KindiCertificate" {
+		next.Set("kind", "KindiKey")
+	} else {
+		next.Set("kind", "moduli")
+	}
+	return s.enqueueJob(c, "rescan-keys", "", next, 0)
+}
+
+// rescanCertificate flags cert, stored under key, if it fails the key
+// checks, and adds its RSA modulus to moduli.
+func (s *server) rescanCertificate(c appengine.Context, key *datastore.Key, cert *KindiCertificate, moduli *[]rescanModulus) error {
+	x509Cert, err := x509.ParseCertificate(cert.CertBytes)
+	if err != nil {
+		c.Warningf("rescan: cannot parse certificate %s: %v", cert.ID, err)
+		return nil
+	}
+	// Flagged certificates still count for finding the keys sharing a
+	// factor with theirs.
+	if rsaKey, ok := x509Cert.PublicKey.(*rsa.PublicKey); ok {
+		*moduli = append(*moduli, rescanModulus{Key: key.Encode(), N: rsaKey.N})
+	}
+	if cert.Flagged != "" {
+		return nil
+	}
+	if problems := s.keys.check(x509Cert); len(problems) > 0 {
+		return s.flagCertificate(c, key, problems[0].Message)
+	}
+	return nil
+}
+
+// rescanModuli is the last rescan-keys run. It flags the certificates
+// whose RSA modulus shares a factor with another one and drops the moduli
+// the earlier runs kept.
+func (s *server) rescanModuli(c appengine.Context, runKey *datastore.Key) error {
+	chunks := make([]KindiRescanModuli, 0)
+	chunkKeys, err := datastore.NewQuery("KindiRescanModuli").Ancestor(runKey).GetAll(c, &chunks)
+	if err != nil {
+		return err
+	}
+
+	// The same key may be published more than once, and a retried batch
+	// keeps its moduli again, so moduli are collected once each with the
+	// certificates using them.
+	moduli := make([]*big.Int, 0)
+	certsOf := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, chunk := range chunks {
+		var batch []rescanModulus
+		err = json.Unmarshal(chunk.Moduli, &batch)
+		if err != nil {
+			return err
+		}
+		for _, m := range batch {
+			n := m.N.String()
+			if seen[n+" "+m.Key] {
+				continue
+			}
+			seen[n+" "+m.Key] = true
+			if certsOf[n] == nil {
+				moduli = append(moduli, m.N)
+			}
+			certsOf[n] = append(certsOf[n], m.Key)
+		}
+	}
+
+	for j := range sharedFactors(moduli) {
+		for _, encoded := range certsOf[moduli[j].String()] {
+			key, err := datastore.DecodeKey(encoded)
+			if err != nil {
+				return err
+			}
+			err = s.flagCertificate(c, key, sharedFactorReason)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return datastore.DeleteMulti(c, chunkKeys)
+}
+
+// flagCertificate takes the certificate under key out of lookups for
+// reason and tells its owner, unless it is gone or was flagged before.
+func (s *server) flagCertificate(c appengine.Context, key *datastore.Key, reason string) error {
+	var cert KindiCertificate
+	flagged := false
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		err := datastore.Get(c, key, &cert)
+		if err == datastore.ErrNoSuchEntity || (err == nil && cert.Flagged != "") {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		cert.Flagged = reason
+		_, err = datastore.Put(c, key, &cert)
+		flagged = err == nil
+		return err
+	}, nil)
+	if err != nil || !flagged {
+		return err
+	}
+	err = forgetCertificates(c, key)
+	if err != nil {
+		return err
+	}
+	c.Warningf("flagged certificate %s of %s: %s", cert.ID, cert.Email, reason)
+
+	s.sendMail(c, &Message{
+		To:      []string{cert.Email},
+		Subject: fmt.Sprintf("Your kindi certificate %q was withdrawn", cert.Name),
+		Body: fmt.Sprintf("Your kindi certificate %q for %s is no longer returned to senders:\n"+
+			"%s.\n\n"+
+			"Create a new key pair and upload its certificate on %s\n",
+			cert.Name, cert.Email, reason, s.jobBaseURL(c)+"/manage"),
+	})
+	return nil
+}
+
+// flagKey takes the bare key under key out of lookups for reason and
+// tells its owner, unless it is gone or was flagged before.
+func (s *server) flagKey(c appengine.Context, key *datastore.Key, reason string) error {
+	var pubKey KindiKey
+	flagged := false
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		err := datastore.Get(c, key, &pubKey)
+		if err == datastore.ErrNoSuchEntity || (err == nil && pubKey.Flagged != "") {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pubKey.Flagged = reason
+		_, err = datastore.Put(c, key, &pubKey)
+		flagged = err == nil
+		return err
+	}, nil)
+	if err != nil || !flagged {
+		return err
+	}
+	c.Warningf("flagged key %s of %s: %s", pubKey.ID, pubKey.Email, reason)
+
+	s.sendMail(c, &Message{
+		To:      []string{pubKey.Email},
+		Subject: fmt.Sprintf("Your kindi key %q was withdrawn", pubKey.Name),
+		Body: fmt.Sprintf("Your kindi key %q for %s is no longer returned to senders:\n"+
+			"%s.\n\n"+
+			"Create a new key pair and upload its public key on %s\n",
+			pubKey.Name, pubKey.Email, reason, s.jobBaseURL(c)+"/manage"),
+	})
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"math/big"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestKeyCheck(t *testing.T) {
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p224, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsa1024, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsa2048, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// divisible is 2048 bits with a factor of 7.
+	divisible := new(big.Int).Mul(big.NewInt(7), new(big.Int).Rsh(rsa2048.N, 2))
+	// Powers of 65537 lie in the subgroups the ROCA test looks for and
+	// have no factor below 1000.
+	roca := new(big.Int).Exp(big.NewInt(65537), big.NewInt(130), nil)
+	otherRSA, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spki := []byte("blocked subject public key info")
+	spkiSum := sha256.Sum256(spki)
+	debian := sha1.Sum([]byte("Modulus=" + strings.ToUpper(otherRSA.N.Text(16)) + "\n"))
+	k := &keyChecker{minRSABits: 2048, minECBits: 256, blocked: map[string]bool{
+		hex.EncodeToString(spkiSum[:]):     true,
+		hex.EncodeToString(debian[:])[20:]: true,
+	}}
+
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want []string
+	}{
+		{"p256", &x509.Certificate{PublicKey: &p256.PublicKey}, nil},
+		{"rsa 2048", &x509.Certificate{PublicKey: &rsa2048.PublicKey}, nil},
+		{"p224", &x509.Certificate{PublicKey: &p224.PublicKey}, []string{"weak_key"}},
+		{"rsa 1024", &x509.Certificate{PublicKey: &rsa1024.PublicKey}, []string{"weak_key"}},
+		{"small factor", &x509.Certificate{PublicKey: &rsa.PublicKey{N: divisible, E: 65537}}, []string{"weak_key"}},
+		{"roca", &x509.Certificate{PublicKey: &rsa.PublicKey{N: roca, E: 65537}}, []string{"roca_key"}},
+		{"blocked key info", &x509.Certificate{PublicKey: &p256.PublicKey, RawSubjectPublicKeyInfo: spki}, []string{"compromised_key"}},
+		{"blocked debian modulus", &x509.Certificate{PublicKey: &otherRSA.PublicKey}, []string{"compromised_key"}},
+	}
+	for _, tt := range tests {
+		got := make([]string, 0)
+		for _, p := range k.check(tt.cert) {
+			if p.Severity != severityError {
+				t.Errorf("%s: %s is a %s, want an error", tt.name, p.Code, p.Severity)
+			}
+			got = append(got, p.Code)
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: got problems %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSharedFactors(t *testing.T) {
+	primes := make([]*big.Int, 12)
+	for i := range primes {
+		p, err := rand.Prime(rand.Reader, 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		primes[i] = p
+	}
+	// n multiplies the primes at indexes i and j.
+	n := func(i, j int) *big.Int {
+		return new(big.Int).Mul(primes[i], primes[j])
+	}
+
+	tests := []struct {
+		name   string
+		moduli []*big.Int
+		want   []int
+	}{
+		{"none", nil, nil},
+		{"one", []*big.Int{n(0, 1)}, nil},
+		{"coprime", []*big.Int{n(0, 1), n(2, 3), n(4, 5)}, nil},
+		{"pair", []*big.Int{n(0, 1), n(0, 2)}, []int{0, 1}},
+		{"pair among others", []*big.Int{n(0, 1), n(2, 3), n(4, 5), n(3, 6)}, []int{1, 3}},
+		// An odd count leaves a node of the product tree unpaired.
+		{"odd count", []*big.Int{n(0, 1), n(2, 3), n(4, 5), n(6, 7), n(0, 8)}, []int{0, 4}},
+		{"three sharing", []*big.Int{n(0, 1), n(2, 3), n(0, 4), n(5, 6), n(0, 7)}, []int{0, 2, 4}},
+		{"both factors shared", []*big.Int{n(0, 1), n(0, 2), n(1, 3)}, []int{0, 1, 2}},
+		{"two groups", []*big.Int{n(0, 1), n(2, 3), n(0, 4), n(5, 2), n(6, 7), n(8, 9), n(10, 11)}, []int{0, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		got := make([]int, 0)
+		for i := range sharedFactors(tt.moduli) {
+			got = append(got, i)
+		}
+		sort.Ints(got)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: sharedFactors = %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: sharedFactors = %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
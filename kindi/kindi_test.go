@@ -0,0 +1,12 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"os"
+)
+
+// The package's init reads kindi.json, the templates and the key
+// blocklist relative to the app root. Package variables are initialized
+// before any init runs, so this moves the tests there in time.
+var _ = os.Chdir("..")
@@ -0,0 +1,155 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// Problems with severity error make the upload fail.
+	severityError   = "error"
+	severityWarning = "warning"
+	severityInfo    = "info"
+)
+
+type lintProblem struct {
+	Code     string `json:"code"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+type lintResult struct {
+	OK             bool          `json:"ok"`
+	Problems       []lintProblem `json:"problems"`
+	Subject        string        `json:"subject,omitempty"`
+	PublishedFrom  *time.Time    `json:"publishedFrom,omitempty"`
+	PublishedUntil *time.Time    `json:"publishedUntil,omitempty"`
+}
+
+// decodeCertificatePEM returns the DER bytes of the first PEM block in
+// data, or the problem that kept it from being a certificate.
+func decodeCertificatePEM(data []byte) ([]byte, *lintProblem) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, &lintProblem{"invalid_pem", severityError, "no PEM block found, paste the text starting with -----BEGIN CERTIFICATE-----"}
+	}
+	if strings.Contains(block.Type, "PRIVATE KEY") {
+		return nil, &lintProblem{"private_key", severityError, "this is a private key, never share it; paste the certificate instead"}
+	}
+	if block.Type != "CERTIFICATE" {
+		return nil, &lintProblem{"invalid_pem", severityError, fmt.Sprintf("PEM block is a %s, not a CERTIFICATE", block.Type)}
+	}
+	return block.Bytes, nil
+}
+
+// lintCertificate lists what is wrong with cert as a certificate published
+// at now for an account with the verified addresses, including what the
+// key checks and the key usage policy find wrong with it.
+func (s *server) lintCertificate(cert *x509.Certificate, addresses []string, now time.Time) []lintProblem {
+	problems := append(s.keys.check(cert), s.lintUsage(cert)...)
+	add := func(code, severity, format string, args ...interface{}) {
+		problems = append(problems, lintProblem{code, severity, fmt.Sprintf(format, args...)})
+	}
+
+	switch cert.SignatureAlgorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA:
+		add("weak_signature", severityError, "certificate is signed with %v, which is broken", cert.SignatureAlgorithm)
+	case x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		add("sha1_signature", severityWarning, "certificate is signed with %v; SHA-1 signatures can be forged", cert.SignatureAlgorithm)
+	}
+
+	if len(cert.EmailAddresses) == 0 {
+		add("no_email_san", severityWarning, "certificate has no email address in its subject alternative names, mail clients may not use it")
+	} else if !hasAnyAddress(s.certAddresses(cert), addresses) {
+		add("email_mismatch", severityWarning, "certificate is for %s, not %s", strings.Join(cert.EmailAddresses, ", "), strings.Join(addresses, " or "))
+	}
+
+	yearOut := now.AddDate(1, 0, 0)
+	switch {
+	case !cert.NotAfter.After(now):
+		add("expired", severityError, "certificate expired on %s", cert.NotAfter.Format("January 2, 2006"))
+	case cert.NotBefore.After(now):
+		add("not_yet_valid", severityWarning, "certificate is not valid before %s and is not returned until then", cert.NotBefore.Format("January 2, 2006"))
+	}
+	if cert.NotAfter.After(yearOut) {
+		add("validity_capped", severityInfo, "certificate is valid until %s but is only published for a year, until %s",
+			cert.NotAfter.Format("January 2, 2006"), yearOut.Format("January 2, 2006"))
+	}
+
+	return problems
+}
+
+// blocking returns the problems that make an upload fail.
+func blocking(problems []lintProblem) []lintProblem {
+	r := make([]lintProblem, 0)
+	for _, p := range problems {
+		if p.Severity == severityError {
+			r = append(r, p)
+		}
+	}
+	return r
+}
+
+func errRejected(problems []lintProblem) *kindiError {
+	msgs := make([]string, len(problems))
+	for i, p := range problems {
+		msgs[i] = p.Message
+	}
+	return newError(http.StatusUnprocessableEntity, "certificate_rejected", "certificate rejected: "+strings.Join(msgs, "; "), nil)
+}
+
+// uploadCheckHandler is a dry run of an upload: it reports what is wrong
+// with the submitted certificate without storing or charging anything.
+func (s *server) uploadCheckHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	certStr := r.FormValue("certificate")
+	if certStr == "" {
+		return badRequest("no_certificate", "no certificate")
+	}
+
+	result := lintResult{Problems: make([]lintProblem, 0)}
+
+	der, problem := decodeCertificatePEM([]byte(certStr))
+	if problem == nil {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			problem = &lintProblem{"invalid_certificate", severityError, "certificate cannot be parsed: " + err.Error()}
+		} else {
+			now := time.Now()
+			from, until := cert.NotBefore, earlier(cert.NotAfter, now.AddDate(1, 0, 0))
+			result.Subject = cert.Subject.String()
+			result.PublishedFrom = &from
+			result.PublishedUntil = &until
+			addresses, err := s.accountAddresses(c, u)
+			if err != nil {
+				return internalError("error reading addresses", err)
+			}
+			result.Problems = s.lintCertificate(cert, addresses, now)
+		}
+	}
+	if problem != nil {
+		result.Problems = append(result.Problems, *problem)
+	}
+	result.OK = len(blocking(result.Problems)) == 0
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return internalError("error marshalling result", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+	return nil
+}
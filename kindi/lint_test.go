@@ -0,0 +1,118 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLintCertificate(t *testing.T) {
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p224, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	// good is a certificate nothing is wrong with; each test changes it.
+	good := func() *x509.Certificate {
+		return &x509.Certificate{
+			PublicKey:          &p256.PublicKey,
+			SignatureAlgorithm: x509.ECDSAWithSHA256,
+			EmailAddresses:     []string{"alice@example.com"},
+			NotBefore:          now.AddDate(0, -1, 0),
+			NotAfter:           now.AddDate(0, 6, 0),
+			KeyUsage:           x509.KeyUsageKeyAgreement | x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+		}
+	}
+
+	s := &server{
+		config: &Config{Usage: UsageConfig{RequireEncryption: true, RequireEmailProtection: true}},
+		keys:   &keyChecker{minRSABits: 2048, minECBits: 256, blocked: make(map[string]bool)},
+	}
+	lenient := &server{
+		config: &Config{Usage: UsageConfig{AllowMissingExtKeyUsage: true}},
+		keys:   s.keys,
+	}
+	folding := &server{
+		config: &Config{Usage: s.config.Usage, Emails: EmailsConfig{FoldCase: []string{"example.com"}}},
+		keys:   s.keys,
+	}
+
+	tests := []struct {
+		name   string
+		s      *server
+		change func(cert *x509.Certificate)
+		// want are the problems expected, as code:severity.
+		want []string
+	}{
+		{"good", s, func(cert *x509.Certificate) {}, nil},
+		{"alias address", s, func(cert *x509.Certificate) { cert.EmailAddresses = []string{"alice@Example.org"} }, nil},
+		{"mixed case address", s, func(cert *x509.Certificate) { cert.EmailAddresses = []string{"ALICE@EXAMPLE.COM"} }, []string{"email_mismatch:warning"}},
+		{"mixed case address, case folded", folding, func(cert *x509.Certificate) { cert.EmailAddresses = []string{"ALICE@EXAMPLE.COM"} }, nil},
+		{"md5 signature", s, func(cert *x509.Certificate) { cert.SignatureAlgorithm = x509.MD5WithRSA }, []string{"weak_signature:error"}},
+		{"sha1 signature", s, func(cert *x509.Certificate) { cert.SignatureAlgorithm = x509.ECDSAWithSHA1 }, []string{"sha1_signature:warning"}},
+		{"no email", s, func(cert *x509.Certificate) { cert.EmailAddresses = nil }, []string{"no_email_san:warning"}},
+		{"other email", s, func(cert *x509.Certificate) { cert.EmailAddresses = []string{"bob@example.com"} }, []string{"email_mismatch:warning"}},
+		{"expired", s, func(cert *x509.Certificate) { cert.NotAfter = now.AddDate(0, 0, -1) }, []string{"expired:error"}},
+		{"not yet valid", s, func(cert *x509.Certificate) { cert.NotBefore = now.AddDate(0, 0, 1) }, []string{"not_yet_valid:warning"}},
+		{"valid for years", s, func(cert *x509.Certificate) { cert.NotAfter = now.AddDate(3, 0, 0) }, []string{"validity_capped:info"}},
+		{"weak key", s, func(cert *x509.Certificate) { cert.PublicKey = &p224.PublicKey }, []string{"weak_key:error"}},
+		{"signing only", s, func(cert *x509.Certificate) { cert.KeyUsage = x509.KeyUsageDigitalSignature }, []string{"no_encryption_usage:error"}},
+		{"signing only, not required", lenient, func(cert *x509.Certificate) { cert.KeyUsage = x509.KeyUsageDigitalSignature }, []string{"no_encryption_usage:warning"}},
+		{"no key usage", s, func(cert *x509.Certificate) { cert.KeyUsage = 0 }, nil},
+		{"ed25519", s, func(cert *x509.Certificate) {
+			cert.PublicKey = edPub
+			cert.KeyUsage = 0
+		}, []string{"signing_key:error"}},
+		{"no ext key usage", s, func(cert *x509.Certificate) { cert.ExtKeyUsage = nil }, []string{"no_ext_key_usage:error"}},
+		{"no ext key usage allowed", lenient, func(cert *x509.Certificate) { cert.ExtKeyUsage = nil }, nil},
+		{"server certificate", s, func(cert *x509.Certificate) { cert.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth} }, []string{"no_email_protection:error"}},
+		{"any ext key usage", s, func(cert *x509.Certificate) { cert.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageAny} }, nil},
+	}
+	for _, tt := range tests {
+		cert := good()
+		tt.change(cert)
+		got := make([]string, 0)
+		for _, p := range tt.s.lintCertificate(cert, []string{"alice@example.com", "alice@example.org"}, now) {
+			got = append(got, p.Code+":"+p.Severity)
+		}
+		sort.Strings(got)
+		sort.Strings(tt.want)
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: got problems %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBlocking(t *testing.T) {
+	problems := []lintProblem{
+		{"expired", severityError, ""},
+		{"sha1_signature", severityWarning, ""},
+		{"validity_capped", severityInfo, ""},
+		{"weak_key", severityError, ""},
+	}
+	got := blocking(problems)
+	if len(got) != 2 || got[0].Code != "expired" || got[1].Code != "weak_key" {
+		t.Errorf("blocking = %v, want the expired and weak_key errors", got)
+	}
+	if got := blocking(problems[1:3]); len(got) != 0 {
+		t.Errorf("blocking = %v for warnings, want none", got)
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"appengine/user"
+
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Orders owners can pick for their certificates in lookups, after the
+// primary one.
+const (
+	orderNewest    = "newest"
+	orderStrongest = "strongest"
+	orderExpires   = "expires"
+)
+
+var lookupOrders = map[string]bool{orderNewest: true, orderStrongest: true, orderExpires: true}
+
+// Selections /rpc/v1 callers can ask for with select. selectAll returns
+// every result in the owner's order, the others one per email.
+const (
+	selectAll       = "all"
+	selectPrimary   = "primary"
+	selectNewest    = "newest"
+	selectStrongest = "strongest"
+)
+
+var lookupSelections = map[string]bool{selectAll: true, selectPrimary: true, selectNewest: true, selectStrongest: true}
+
+// lookupCandidate is a live certificate or key found for an email, with
+// what selecting among them needs.
+type lookupCandidate struct {
+	result    rpcCertificate
+	owner     string
+	primary   bool
+	processed time.Time
+	expires   time.Time
+	strength  int
+}
+
+// securityStrength is the strength in bits of a key of algorithm alg
+// with size bits, following NIST SP 800-57 for RSA.
+func securityStrength(alg string, bits int) int {
+	switch {
+	case alg == "RSA":
+		for _, s := range []struct{ bits, strength int }{{15360, 256}, {7680, 192}, {3072, 128}, {2048, 112}, {1024, 80}} {
+			if bits >= s.bits {
+				return s.strength
+			}
+		}
+		return 0
+	case strings.HasPrefix(alg, "ECDSA"):
+		return bits / 2
+	case alg == algEd25519, alg == algX25519, alg == algECDHP256:
+		return 128
+	case alg == algMLKEM768:
+		return 192
+	case alg == algMLKEM1024:
+		return 256
+	}
+	return 0
+}
+
+// newer orders a before b when it was processed later.
+func newer(a, b *lookupCandidate) bool {
+	return a.processed.After(b.processed)
+}
+
+func stronger(a, b *lookupCandidate) bool {
+	if a.strength != b.strength {
+		return a.strength > b.strength
+	}
+	return newer(a, b)
+}
+
+// preferred orders candidates the way their owners asked for: the
+// primary first, current before outgoing, then by the owner's order.
+// Candidates of different owners go newest first.
+func preferred(a, b *lookupCandidate, orders map[string]string) bool {
+	if a.primary != b.primary {
+		return a.primary
+	}
+	if a.result.Status != b.result.Status {
+		return a.result.Status == "current"
+	}
+	if a.owner != b.owner {
+		return newer(a, b)
+	}
+	switch orders[a.owner] {
+	case orderStrongest:
+		return stronger(a, b)
+	case orderExpires:
+		if !a.expires.Equal(b.expires) {
+			return a.expires.After(b.expires)
+		}
+	}
+	return newer(a, b)
+}
+
+// selectCandidates picks from the candidates for one email what sel asks
+// for. orders holds the owners' orders.
+func selectCandidates(cands []lookupCandidate, sel string, orders map[string]string) []lookupCandidate {
+	if len(cands) == 0 {
+		return cands
+	}
+	sort.SliceStable(cands, func(i, j int) bool {
+		switch sel {
+		case selectNewest:
+			return newer(&cands[i], &cands[j])
+		case selectStrongest:
+			return stronger(&cands[i], &cands[j])
+		}
+		return preferred(&cands[i], &cands[j], orders)
+	})
+	if sel == selectAll {
+		return cands
+	}
+	return cands[:1]
+}
+
+// lookupOrdersOf returns the orders of owners, reading the accounts
+// missing from orders.
+func lookupOrdersOf(c appengine.Context, owners []string, orders map[string]string) error {
+	for _, owner := range owners {
+		if _, ok := orders[owner]; ok {
+			continue
+		}
+		account, err := getAccount(c, owner)
+		if err == datastore.ErrNoSuchEntity {
+			orders[owner] = ""
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		orders[owner] = account.LookupOrder
+	}
+	return nil
+}
+
+// primaryFor reports whether the owner prefers cert for the canonical
+// address.
+func (cert *KindiCertificate) primaryFor(address string) bool {
+	return hasAddress(cert.PrimaryFor, address)
+}
+
+// dedupe drops results whose bytes were already in seen, adding the rest.
+func dedupe(cands []lookupCandidate, seen map[[32]byte]bool) []rpcCertificate {
+	r := make([]rpcCertificate, 0, len(cands))
+	for _, cand := range cands {
+		sum := sha256.Sum256(cand.result.Bytes)
+		if seen[sum] {
+			continue
+		}
+		seen[sum] = true
+		r = append(r, cand.result)
+	}
+	return r
+}
+
+// primaryHandler makes a certificate the primary one for address, the
+// login email if not given, or with unset=1 takes that away.
+func (s *server) primaryHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		return badRequest("no_certificate", "no certificate id given")
+	}
+	address := s.canonical(u.Email)
+	if a := r.FormValue("address"); a != "" {
+		address = s.canonical(a)
+	}
+
+	owned, err := s.accountAddresses(c, u)
+	if err != nil {
+		return internalError("error reading addresses", err)
+	}
+
+	err = setPrimary(c, u, id, address, owned, r.FormValue("unset") != "1")
+	if err != nil {
+		return asKindiError(err, "error saving certificate")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, "ok")
+	return nil
+}
+
+// setPrimary marks the certificate id primary for the canonical address,
+// clearing the mark for address on the account's other certificates.
+// owned are the account's verified addresses.
+func setPrimary(c appengine.Context, u *user.User, id, address string, owned []string, primary bool) error {
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var cert KindiCertificate
+		err := datastore.Get(c, datastore.NewKey(c, "KindiCertificate", id, 0, accountKey), &cert)
+		if err == datastore.ErrNoSuchEntity {
+			return notFound("no_certificate", "no such certificate")
+		}
+		if err != nil {
+			return err
+		}
+		if primary && !cert.publishedUnder(address, owned) {
+			return badRequest("bad_address", "certificate is not published under "+address)
+		}
+
+		certs := make([]KindiCertificate, 0)
+		keys, err := datastore.NewQuery("KindiCertificate").Ancestor(accountKey).GetAll(c, &certs)
+		if err != nil {
+			return err
+		}
+
+		changed := make([]*datastore.Key, 0)
+		changedCerts := make([]KindiCertificate, 0)
+		for i := range certs {
+			cert := &certs[i]
+			was := cert.primaryFor(address)
+			want := was
+			switch {
+			case cert.ID == id:
+				want = primary
+			case primary:
+				want = false
+			}
+			if want == was {
+				continue
+			}
+			cert.PrimaryFor = withoutAddress(cert.PrimaryFor, address)
+			if want {
+				cert.PrimaryFor = append(cert.PrimaryFor, address)
+			}
+			changed = append(changed, keys[i])
+			changedCerts = append(changedCerts, *cert)
+		}
+
+		_, err = datastore.PutMulti(c, changed, changedCerts)
+		if err != nil {
+			return err
+		}
+		err = memcache.Delete(c, u.ID+"-certs")
+		if err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+		return nil
+	}, nil)
+}
+
+// lookupOrderHandler sets the order the account's certificates are
+// returned in.
+func (s *server) lookupOrderHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	order := r.FormValue("order")
+	if !lookupOrders[order] {
+		return badRequest("bad_order", "order must be newest, strongest or expires")
+	}
+
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	err := datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var account KindiAccount
+		err := datastore.Get(c, accountKey, &account)
+		if err != nil {
+			return err
+		}
+		account.LookupOrder = order
+		_, err = datastore.Put(c, accountKey, &account)
+		if err != nil {
+			return err
+		}
+		return memcache.JSON.Set(c, &memcache.Item{
+			Key:    u.ID,
+			Object: account,
+		})
+	}, nil)
+	if err != nil {
+		return asKindiError(err, "error saving account")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, "ok")
+	return nil
+}
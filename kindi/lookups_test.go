@@ -0,0 +1,212 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecurityStrength(t *testing.T) {
+	tests := []struct {
+		alg  string
+		bits int
+		want int
+	}{
+		{"RSA", 512, 0},
+		{"RSA", 1024, 80},
+		{"RSA", 2048, 112},
+		{"RSA", 3072, 128},
+		{"RSA", 4096, 128},
+		{"RSA", 7680, 192},
+		{"RSA", 15360, 256},
+		{"ECDSA P-256", 256, 128},
+		{"ECDSA P-384", 384, 192},
+		{"ECDSA P-521", 521, 260},
+		{algEd25519, 256, 128},
+		{algX25519, 0, 128},
+		{algECDHP256, 0, 128},
+		{algMLKEM768, 0, 192},
+		{algMLKEM1024, 0, 256},
+		{"DSA", 2048, 0},
+	}
+	for _, tt := range tests {
+		if got := securityStrength(tt.alg, tt.bits); got != tt.want {
+			t.Errorf("securityStrength(%q, %d) = %d, want %d", tt.alg, tt.bits, got, tt.want)
+		}
+	}
+}
+
+// testCandidate is a lookup candidate named by its bytes.
+type testCandidate struct {
+	name     string
+	owner    string
+	primary  bool
+	outgoing bool
+	// processed and expires are days into 2012.
+	processed, expires int
+	strength           int
+}
+
+func candidates(tcs ...testCandidate) []lookupCandidate {
+	day := func(n int) time.Time {
+		return time.Date(2012, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, n)
+	}
+	r := make([]lookupCandidate, 0, len(tcs))
+	for _, tc := range tcs {
+		cand := lookupCandidate{
+			owner:     tc.owner,
+			primary:   tc.primary,
+			processed: day(tc.processed),
+			expires:   day(tc.expires),
+			strength:  tc.strength,
+		}
+		cand.result.Bytes = []byte(tc.name)
+		cand.result.Status = "current"
+		if tc.outgoing {
+			cand.result.Status = "outgoing"
+		}
+		r = append(r, cand)
+	}
+	return r
+}
+
+func candidateNames(cands []lookupCandidate) string {
+	names := make([]string, 0, len(cands))
+	for _, cand := range cands {
+		names = append(names, string(cand.result.Bytes))
+	}
+	return strings.Join(names, " ")
+}
+
+func TestSelectCandidates(t *testing.T) {
+	tests := []struct {
+		name   string
+		cands  []lookupCandidate
+		sel    string
+		orders map[string]string
+		want   string
+	}{
+		{"none", candidates(), selectAll, nil, ""},
+		{"none for primary", candidates(), selectPrimary, nil, ""},
+		{"newest first by default", candidates(
+			testCandidate{name: "a", owner: "x", processed: 1},
+			testCandidate{name: "b", owner: "x", processed: 3},
+			testCandidate{name: "c", owner: "x", processed: 2},
+		), selectAll, nil, "b c a"},
+		{"primary first", candidates(
+			testCandidate{name: "a", owner: "x", processed: 3},
+			testCandidate{name: "b", owner: "x", primary: true, processed: 1},
+			testCandidate{name: "c", owner: "x", processed: 2},
+		), selectAll, nil, "b a c"},
+		{"primary over current", candidates(
+			testCandidate{name: "a", owner: "x", processed: 3},
+			testCandidate{name: "b", owner: "x", primary: true, outgoing: true, processed: 1},
+		), selectAll, nil, "b a"},
+		{"current before outgoing", candidates(
+			testCandidate{name: "a", owner: "x", outgoing: true, processed: 3},
+			testCandidate{name: "b", owner: "x", processed: 1},
+		), selectAll, nil, "b a"},
+		{"owner wants strongest", candidates(
+			testCandidate{name: "a", owner: "x", processed: 3, strength: 112},
+			testCandidate{name: "b", owner: "x", processed: 1, strength: 128},
+			testCandidate{name: "c", owner: "x", processed: 2, strength: 128},
+		), selectAll, map[string]string{"x": orderStrongest}, "c b a"},
+		{"owner wants longest valid", candidates(
+			testCandidate{name: "a", owner: "x", processed: 1, expires: 30},
+			testCandidate{name: "b", owner: "x", processed: 2, expires: 10},
+			testCandidate{name: "c", owner: "x", processed: 3, expires: 30},
+		), selectAll, map[string]string{"x": orderExpires}, "c a b"},
+		{"owner wants newest", candidates(
+			testCandidate{name: "a", owner: "x", processed: 1, strength: 256},
+			testCandidate{name: "b", owner: "x", processed: 2, strength: 112},
+		), selectAll, map[string]string{"x": orderNewest}, "b a"},
+		{"different owners newest first", candidates(
+			testCandidate{name: "a", owner: "x", processed: 1, strength: 256},
+			testCandidate{name: "b", owner: "y", processed: 2, strength: 112},
+		), selectAll, map[string]string{"x": orderStrongest}, "b a"},
+		{"primary of one owner first", candidates(
+			testCandidate{name: "a", owner: "x", processed: 3},
+			testCandidate{name: "b", owner: "y", primary: true, processed: 1},
+		), selectAll, nil, "b a"},
+		{"select primary", candidates(
+			testCandidate{name: "a", owner: "x", processed: 3},
+			testCandidate{name: "b", owner: "x", primary: true, processed: 1},
+		), selectPrimary, nil, "b"},
+		{"select primary without one", candidates(
+			testCandidate{name: "a", owner: "x", processed: 1, strength: 256},
+			testCandidate{name: "b", owner: "x", processed: 2, strength: 112},
+		), selectPrimary, map[string]string{"x": orderStrongest}, "a"},
+		{"select newest ignores primary", candidates(
+			testCandidate{name: "a", owner: "x", primary: true, processed: 1},
+			testCandidate{name: "b", owner: "x", outgoing: true, processed: 2},
+		), selectNewest, nil, "b"},
+		{"select strongest across owners", candidates(
+			testCandidate{name: "a", owner: "x", primary: true, processed: 1, strength: 128},
+			testCandidate{name: "b", owner: "y", processed: 2, strength: 192},
+			testCandidate{name: "c", owner: "x", processed: 3, strength: 128},
+		), selectStrongest, nil, "b"},
+		{"select strongest breaks ties by age", candidates(
+			testCandidate{name: "a", owner: "x", processed: 1, strength: 128},
+			testCandidate{name: "b", owner: "y", processed: 2, strength: 128},
+		), selectStrongest, nil, "b"},
+	}
+	for _, tt := range tests {
+		orders := tt.orders
+		if orders == nil {
+			orders = make(map[string]string)
+		}
+		if got := candidateNames(selectCandidates(tt.cands, tt.sel, orders)); got != tt.want {
+			t.Errorf("%s: selected %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	seen := make(map[[32]byte]bool)
+	first := dedupe(candidates(
+		testCandidate{name: "a"},
+		testCandidate{name: "b"},
+		testCandidate{name: "a"},
+	), seen)
+	second := dedupe(candidates(
+		testCandidate{name: "b"},
+		testCandidate{name: "c"},
+	), seen)
+
+	names := func(results []rpcCertificate) string {
+		r := make([]string, 0, len(results))
+		for _, result := range results {
+			r = append(r, string(result.Bytes))
+		}
+		return strings.Join(r, " ")
+	}
+	if got := names(first); got != "a b" {
+		t.Errorf("dedupe = %q, want %q", got, "a b")
+	}
+	// Results already returned for an earlier email are dropped.
+	if got := names(second); got != "c" {
+		t.Errorf("dedupe = %q on the second email, want %q", got, "c")
+	}
+}
+
+func TestPrimaryFor(t *testing.T) {
+	cert := &KindiCertificate{Email: "alice@example.com", PrimaryFor: []string{"alice@example.com"}}
+	if !cert.primaryFor("alice@example.com") {
+		t.Errorf("primaryFor(alice@example.com) = false, want true")
+	}
+	if cert.primaryFor("bob@example.com") {
+		t.Errorf("primaryFor(bob@example.com) = true, want false")
+	}
+	cert.PrimaryFor = nil
+	if cert.primaryFor("alice@example.com") {
+		t.Errorf("primaryFor(alice@example.com) = true without a mark, want false")
+	}
+	// A certificate can be primary for an alias and not its own email.
+	cert.PrimaryFor = []string{"alice@example.org"}
+	if cert.primaryFor("alice@example.com") || !cert.primaryFor("alice@example.org") {
+		t.Errorf("primaryFor marked for alice@example.org = %v for alice@example.com and %v for alice@example.org, want false and true",
+			cert.primaryFor("alice@example.com"), cert.primaryFor("alice@example.org"))
+	}
+}
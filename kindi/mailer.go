@@ -0,0 +1,406 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+	"appengine/socket"
+
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Message is an outgoing email. From defaults to the configured system
+// address; mail sent on behalf of a user puts the user in ReplyTo.
+type Message struct {
+	From     string
+	ReplyTo  string
+	To       []string
+	Cc       []string
+	Subject  string
+	Body     string
+	HTMLBody string
+	Headers  map[string]string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(c appengine.Context, msg *Message) error
+}
+
+func newMailer(cfg MailConfig, secrets SecretProvider) Mailer {
+	switch cfg.Transport {
+	case "smtp":
+		return &smtpMailer{cfg: cfg.SMTP, secrets: secrets}
+	case "file":
+		return &maildirMailer{dir: cfg.Dir}
+	}
+	return appengineMailer{}
+}
+
+// appengineMailer sends through the App Engine mail API. Its From must be
+// an address App Engine is allowed to send from.
+type appengineMailer struct{}
+
+func (appengineMailer) Send(c appengine.Context, msg *Message) error {
+	headers := make(netmail.Header)
+	for k, v := range msg.Headers {
+		headers[k] = []string{v}
+	}
+	return mail.Send(c, &mail.Message{
+		Sender:   msg.From,
+		ReplyTo:  msg.ReplyTo,
+		To:       msg.To,
+		Cc:       msg.Cc,
+		Subject:  msg.Subject,
+		Body:     msg.Body,
+		HTMLBody: msg.HTMLBody,
+		Headers:  headers,
+	})
+}
+
+// smtpMailer sends through an SMTP relay, upgrading the connection with
+// STARTTLS and authenticating when a username is configured. It connects
+// through the sockets API, the only way out of the go1 runtime.
+type smtpMailer struct {
+	cfg     SMTPConfig
+	secrets SecretProvider
+}
+
+func (m *smtpMailer) Send(c appengine.Context, msg *Message) error {
+	data, err := msg.bytes()
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(m.cfg.Host, fmt.Sprint(m.cfg.Port))
+	conn, err := socket.DialTimeout(c, "tcp", addr, m.cfg.Timeout.Duration)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(m.cfg.Timeout.Duration))
+
+	client, err := smtp.NewClient(conn, m.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: m.cfg.Host})
+		if err != nil {
+			return err
+		}
+	} else if m.cfg.RequireTLS {
+		return fmt.Errorf("smtp server %s does not support STARTTLS", m.cfg.Host)
+	}
+
+	if m.cfg.Username != "" {
+		password, err := m.secrets.Secret(c, m.cfg.PasswordName)
+		if err != nil {
+			return err
+		}
+		err = client.Auth(smtp.PlainAuth("", m.cfg.Username, password, m.cfg.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	from, err := netmail.ParseAddress(msg.From)
+	if err != nil {
+		return err
+	}
+	err = client.Mail(from.Address)
+	if err != nil {
+		return err
+	}
+	recipients, err := msg.recipients()
+	if err != nil {
+		return err
+	}
+	for _, rcpt := range recipients {
+		err = client.Rcpt(rcpt)
+		if err != nil {
+			return err
+		}
+	}
+
+	wc, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = wc.Write(data)
+	if err != nil {
+		wc.Close()
+		return err
+	}
+	err = wc.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// maildirMailer delivers into a maildir on local disk. Meant for the dev
+// server and tests.
+type maildirMailer struct {
+	dir string
+}
+
+func (m *maildirMailer) Send(c appengine.Context, msg *Message) error {
+	data, err := msg.bytes()
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		err = os.MkdirAll(filepath.Join(m.dir, sub), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	name := fmt.Sprintf("%d.%s.kindi", time.Now().UnixNano(), randomHex(8))
+	tmp := filepath.Join(m.dir, "tmp", name)
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(m.dir, "new", name))
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (msg *Message) recipients() ([]string, error) {
+	r := make([]string, 0, len(msg.To)+len(msg.Cc))
+	for _, list := range [][]string{msg.To, msg.Cc} {
+		for _, rcpt := range list {
+			addr, err := netmail.ParseAddress(rcpt)
+			if err != nil {
+				return nil, fmt.Errorf("bad recipient %q: %v", rcpt, err)
+			}
+			r = append(r, addr.Address)
+		}
+	}
+	return r, nil
+}
+
+// formatAddresses parses addrs and formats them for a header, encoding
+// names so that nothing can break out of the header line.
+func formatAddresses(addrs ...string) (string, error) {
+	r := make([]string, len(addrs))
+	for i, a := range addrs {
+		addr, err := netmail.ParseAddress(a)
+		if err != nil {
+			return "", fmt.Errorf("bad address %q: %v", a, err)
+		}
+		r[i] = addr.String()
+	}
+	return strings.Join(r, ", "), nil
+}
+
+// bytes renders msg as an RFC 5322 message. A message with an HTML body
+// becomes multipart/alternative.
+func (msg *Message) bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	header := func(k, v string) {
+		fmt.Fprintf(buf, "%s: %s\r\n", k, v)
+	}
+	addressHeader := func(k string, addrs ...string) error {
+		if len(addrs) == 0 {
+			return nil
+		}
+		v, err := formatAddresses(addrs...)
+		if err == nil {
+			header(k, v)
+		}
+		return err
+	}
+	err := addressHeader("From", msg.From)
+	if err == nil {
+		err = addressHeader("To", msg.To...)
+	}
+	if err == nil {
+		err = addressHeader("Cc", msg.Cc...)
+	}
+	if err == nil && msg.ReplyTo != "" {
+		err = addressHeader("Reply-To", msg.ReplyTo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-Id", fmt.Sprintf("<%s@kindi>", randomHex(16)))
+	header("MIME-Version", "1.0")
+
+	keys := make([]string, 0, len(msg.Headers))
+	for k := range msg.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		header(k, msg.Headers[k])
+	}
+
+	if msg.HTMLBody == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		err = writeQuotedPrintable(buf, msg.Body)
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(buf)
+	header("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	buf.WriteString("\r\n")
+
+	parts := []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Body},
+		{"text/html; charset=utf-8", msg.HTMLBody},
+	}
+	for _, part := range parts {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = writeQuotedPrintable(pw, part.body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = mw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qw := quotedprintable.NewWriter(w)
+	_, err := qw.Write([]byte(s))
+	if err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+// KindiOutboxMail is a message that could not be sent yet. The retry-mail
+// job sends it again at NextAttempt.
+type KindiOutboxMail struct {
+	Message     []byte `datastore:",noindex"`
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string `datastore:",noindex"`
+}
+
+// Outbox mails retried per retry-mail run.
+const outboxBatch = 100
+
+// sendMail fills in the system From address and sends msg. If sending
+// fails the message goes to the outbox and is retried with backoff.
+func (s *server) sendMail(c appengine.Context, msg *Message) {
+	if msg.From == "" {
+		msg.From = s.mailFrom(c)
+	}
+	err := s.mailer.Send(c, msg)
+	if err == nil {
+		return
+	}
+	c.Warningf("error sending mail to %v, queueing retry: %v", msg.To, err)
+
+	data, jerr := json.Marshal(msg)
+	if jerr != nil {
+		c.Errorf("error queueing mail to %v: %v", msg.To, jerr)
+		return
+	}
+	_, err = datastore.Put(c, datastore.NewIncompleteKey(c, "KindiOutboxMail", nil), &KindiOutboxMail{
+		Message:     data,
+		Attempts:    1,
+		NextAttempt: time.Now().Add(backoff(s.config.Jobs, 1)),
+		LastError:   err.Error(),
+	})
+	if err != nil {
+		c.Errorf("error queueing mail to %v: %v", msg.To, err)
+	}
+}
+
+// retryMail sends the outbox mails that are due. Mails that keep failing
+// are given up after jobs.maxAttempts.
+func (s *server) retryMail(c appengine.Context, params url.Values) error {
+	outbox := make([]KindiOutboxMail, 0)
+	q := datastore.NewQuery("KindiOutboxMail").Filter("NextAttempt<=", time.Now()).Limit(outboxBatch)
+	keys, err := q.GetAll(c, &outbox)
+	if err != nil {
+		return err
+	}
+
+	for i := range outbox {
+		item := &outbox[i]
+
+		var msg Message
+		err = json.Unmarshal(item.Message, &msg)
+		if err == nil {
+			err = s.mailer.Send(c, &msg)
+		}
+		if err == nil || item.Attempts+1 >= s.config.Jobs.MaxAttempts {
+			if err != nil {
+				c.Errorf("giving up on mail to %v after %d attempts: %v", msg.To, item.Attempts+1, err)
+			}
+			err = datastore.Delete(c, keys[i])
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		item.Attempts++
+		item.NextAttempt = time.Now().Add(backoff(s.config.Jobs, item.Attempts))
+		item.LastError = err.Error()
+		_, err = datastore.Put(c, keys[i], item)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *server) mailFrom(c appengine.Context) string {
+	if s.config.Mail.From != "" {
+		return s.config.Mail.From
+	}
+	return "kindi <kindi@" + appengine.AppID(c) + ".appspotmail.com>"
+}
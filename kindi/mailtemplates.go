@@ -0,0 +1,205 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// mailBundle holds the invite mail templates of every locale. Each locale
+// is a directory under the bundle root with invite.txt, which also
+// defines the "subject" template, and invite.html.
+type mailBundle struct {
+	locales  map[string]*mailLocale
+	fallback string
+}
+
+type mailLocale struct {
+	text *texttemplate.Template
+	html *template.Template
+}
+
+type renderedMail struct {
+	Locale  string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+func loadMailBundle(dir, fallback string) (*mailBundle, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("mail templates: %v", err)
+	}
+
+	fallback = strings.ToLower(fallback)
+	b := &mailBundle{
+		locales:  make(map[string]*mailLocale),
+		fallback: fallback,
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		locale := strings.ToLower(entry.Name())
+		ml := new(mailLocale)
+		ml.text, err = texttemplate.ParseFiles(filepath.Join(dir, entry.Name(), "invite.txt"))
+		if err != nil {
+			return nil, fmt.Errorf("mail templates for %s: %v", locale, err)
+		}
+		if ml.text.Lookup("subject") == nil {
+			return nil, fmt.Errorf("mail templates for %s: invite.txt defines no subject", locale)
+		}
+		ml.html, err = template.ParseFiles(filepath.Join(dir, entry.Name(), "invite.html"))
+		if err != nil {
+			return nil, fmt.Errorf("mail templates for %s: %v", locale, err)
+		}
+		b.locales[locale] = ml
+	}
+
+	if _, ok := b.locales[fallback]; !ok {
+		return nil, fmt.Errorf("mail templates: no templates for default locale %q in %s", fallback, dir)
+	}
+	return b, nil
+}
+
+// pick returns the first of the preferred locales the bundle has, trying
+// "de" for "de-AT", and the fallback if none match.
+func (b *mailBundle) pick(prefs ...string) string {
+	for _, pref := range prefs {
+		pref = strings.ToLower(strings.Replace(strings.TrimSpace(pref), "_", "-", -1))
+		if pref == "" {
+			continue
+		}
+		if _, ok := b.locales[pref]; ok {
+			return pref
+		}
+		if i := strings.Index(pref, "-"); i > 0 {
+			if _, ok := b.locales[pref[:i]]; ok {
+				return pref[:i]
+			}
+		}
+	}
+	return b.fallback
+}
+
+func (b *mailBundle) renderInvite(locale string, data MailTmplData) (*renderedMail, error) {
+	ml, ok := b.locales[locale]
+	if !ok {
+		locale = b.fallback
+		ml = b.locales[locale]
+	}
+
+	subject := new(bytes.Buffer)
+	err := ml.text.ExecuteTemplate(subject, "subject", data)
+	if err != nil {
+		return nil, err
+	}
+	text := new(bytes.Buffer)
+	err = ml.text.Execute(text, data)
+	if err != nil {
+		return nil, err
+	}
+	html := new(bytes.Buffer)
+	err = ml.html.Execute(html, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &renderedMail{
+		Locale:  locale,
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+// acceptLanguages returns the language tags of an Accept-Language header,
+// most preferred first.
+func acceptLanguages(header string) []string {
+	type lang struct {
+		tag string
+		q   float64
+	}
+	langs := make([]lang, 0)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		langs = append(langs, lang{tag, q})
+	}
+
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+
+	r := make([]string, len(langs))
+	for i, l := range langs {
+		r[i] = l.tag
+	}
+	return r
+}
+
+// inviteLocale picks the invite language: the one the inviter chose for
+// the recipient, else the inviter's browser languages.
+func (s *server) inviteLocale(r *http.Request) string {
+	prefs := append([]string{r.FormValue("locale")}, acceptLanguages(r.Header.Get("Accept-Language"))...)
+	return s.mailTmpls.pick(prefs...)
+}
+
+// invitePreviewHandler renders an invite the way it would be sent, without
+// sending it, so deployments can check their templates.
+func (s *server) invitePreviewHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	recipient := r.FormValue("recipient")
+	if recipient == "" {
+		recipient = "recipient@example.com"
+	}
+
+	data := MailTmplData{
+		Recipient:   recipient,
+		Sender:      u.Email,
+		Note:        r.FormValue("note"),
+		Link:        s.absURL(r, "/accept?i=preview"),
+		Unsubscribe: s.absURL(r, "/unsubscribe?e=preview"),
+	}
+
+	mail, err := s.mailTmpls.renderInvite(s.inviteLocale(r), data)
+	if err != nil {
+		return internalError("error rendering invite", err)
+	}
+
+	w.Header().Set("Content-Language", mail.Locale)
+	if r.FormValue("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "Subject: %s\n\n%s", mail.Subject, mail.Text)
+		return nil
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, mail.HTML)
+	return nil
+}
@@ -18,7 +18,7 @@ var tableTmpl *template.Template
 func init() {
 	root := template.New("root")
 	root = root.Funcs(template.FuncMap{"formatTime": FormatTime})
-	root = template.Must(root.ParseFiles("tmpl/manage.html", "tmpl/certificates_table.html", "tmpl/payments.html"))
+	root = template.Must(root.ParseFiles("tmpl/manage.html", "tmpl/certificates_table.html", "tmpl/watches_table.html", "tmpl/payments.html"))
 	manageTmpl = root.Lookup("manage.html")
 	tableTmpl = manageTmpl.Lookup("certificates_table.html")
 }
@@ -27,6 +27,20 @@ type ManageTmplData struct {
 	Username     string
 	KindiCoins   int
 	Certificates []KindiCertificate
+	Watches      []KindiWatch
+	CSRFToken    string
+	InviteRef    string
+	// Renew is the certificate the reminder link asked to renew.
+	Renew       *KindiCertificate
+	Reminders   bool
+	LookupOrder string
+	Addresses   []emailEntry
+	// MailToken is the code for registering by mail, empty when that is
+	// turned off.
+	MailToken string
+
+	CaptchaProvider string
+	CaptchaSiteKey  string
 }
 
 func FormatTime(args ...interface{}) string {
@@ -42,38 +56,67 @@ func FormatTime(args ...interface{}) string {
 	return t.Format("January 2, 2006 at 3:04 pm")
 }
 
-func manageHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+func (s *server) manageHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
 	u := user.Current(c)
 	if u == nil {
-		url, err := user.LoginURL(c, r.URL.String())
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Location", url)
-		w.WriteHeader(http.StatusFound)
-		return
+		return redirectToLogin(c, w, r)
 	}
 
-	account, err := getOrCreateAccount(c, u)
+	account, err := s.getOrCreateAccount(c, u)
 	if err != nil {
-		c.Errorf("error retrieving account: %v", err)
-		http.Error(w, "error retrieving account", http.StatusInternalServerError)
-		return
+		return asKindiError(err, "error retrieving account")
 	}
 
 	certs, err := getUserCertificates(c, u)
 	if err != nil {
-		c.Errorf("error retrieving certificates: %v", err)
-		http.Error(w, "error retrieving certificates", http.StatusInternalServerError)
-		return
+		return asKindiError(err, "error retrieving certificates")
+	}
+
+	watches, err := getUserWatches(c, u.ID)
+	if err != nil {
+		return asKindiError(err, "error retrieving watches")
+	}
+
+	addresses, err := accountEmails(c, u)
+	if err != nil {
+		return internalError("error retrieving addresses", err)
+	}
+
+	csrfToken, err := s.csrfToken(c, u.ID)
+	if err != nil {
+		return internalError("error creating csrf token", err)
+	}
+
+	mailToken := ""
+	if s.inboundRoots != nil {
+		mailToken, err = s.mailToken(c, u.ID)
+		if err != nil {
+			return internalError("error creating mail token", err)
+		}
 	}
 
 	data := ManageTmplData{
 		Username:     u.String(),
 		KindiCoins:   account.KindiCoins,
 		Certificates: certs,
+		Watches:      watches,
+		CSRFToken:    csrfToken,
+		InviteRef:    r.FormValue("invite"),
+		Reminders:    !account.NoReminders,
+		LookupOrder:  account.LookupOrder,
+		Addresses:    addresses,
+		MailToken:    mailToken,
+
+		CaptchaProvider: s.config.Captcha.Provider,
+		CaptchaSiteKey:  s.config.Captcha.SiteKey,
+	}
+
+	if renew := r.FormValue("renew"); renew != "" {
+		for i := range certs {
+			if certs[i].ID == renew {
+				data.Renew = &certs[i]
+			}
+		}
 	}
 
 	tableOnly := r.FormValue("tableOnly")
@@ -88,6 +131,17 @@ func manageHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		return internalError("error rendering page", err)
+	}
+	return nil
+}
+
+func redirectToLogin(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	url, err := user.LoginURL(c, r.URL.String())
+	if err != nil {
+		return internalError("error creating login url", err)
 	}
+	w.Header().Set("Location", url)
+	w.WriteHeader(http.StatusFound)
+	return nil
 }
@@ -11,6 +11,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -18,24 +19,27 @@ import (
 	"github.com/uwedeportivo/shared/jwt"
 )
 
-const (
-	sellerIdentifier = "......"
-	sellerSecret     = "......"
-	promo            = "......"
-	promoCount       = 100
-)
-
 type KindiOrder struct {
 	Email      string
 	OrderId    string
 	Processed  time.Time
 	KindiCoins int
+	// Anonymized orders belonged to a deleted account. They are kept
+	// without a parent or email for accounting.
+	Anonymized bool
 }
 
 type KindiPromo struct {
 	Code string
 }
 
+// KindiPromoCounter counts the KindiPromo redemptions of the promo code
+// it is keyed by. Redemptions are stored as its children so both are
+// updated in one transaction.
+type KindiPromoCounter struct {
+	Count int
+}
+
 func parseSellerData(sellerData string) (string, int, error) {
 	parts := strings.Split(sellerData, ",")
 	if len(parts) != 2 {
@@ -68,7 +72,7 @@ func parseSellerData(sellerData string) (string, int, error) {
 func processCoinOrder(c appengine.Context, orderId string, sellerData string) error {
 	userId, quantity, err := parseSellerData(sellerData)
 	if err != nil {
-		return err
+		return newError(http.StatusBadRequest, "invalid_seller_data", "invalid seller data", err)
 	}
 
 	return processCoins(c, orderId, userId, quantity)
@@ -108,105 +112,106 @@ func processCoins(c appengine.Context, orderId string, userId string, quantity i
 	}, nil)
 }
 
-func buyHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
+func (s *server) buyHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
 	jot := r.FormValue("jwt")
 
-	token, err := jwt.Decode(jot, sellerIdentifier, sellerSecret, false)
+	sellerSecret, err := s.secrets.Secret(c, s.config.Seller.SecretName)
 	if err != nil {
-		c.Errorf("error decoding jwt: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return internalError("error reading seller secret", err)
+	}
+
+	token, err := jwt.Decode(jot, s.config.Seller.Identifier, sellerSecret, false)
+	if err != nil {
+		return newError(http.StatusBadRequest, "invalid_jwt", "error decoding jwt", err)
 	}
 
 	// TODO(uwe): verify jwt more thoroughly
-	if token.Response != nil && token.Request != nil {
-		orderId := token.Response["orderId"]
-		sellerData := token.Request["sellerData"]
+	if token.Response == nil || token.Request == nil {
+		c.Errorf("invalid jwt: %v", *token)
+		return badRequest("invalid_jwt", "invalid jwt")
+	}
 
-		if orderId != "" && sellerData != "" {
-			err = processCoinOrder(c, orderId, sellerData)
+	orderId := token.Response["orderId"]
+	sellerData := token.Request["sellerData"]
 
-			if err != nil {
-				c.Errorf("error processing jwt: %v %v", *token, err)
-				http.Error(w, "error processing jwt", http.StatusInternalServerError)
-				return
-			}
-			fmt.Fprint(w, orderId)
-		} else {
-			c.Errorf("invalid jwt: %v", *token)
-			http.Error(w, "invalid jwt", http.StatusInternalServerError)
-		}
-	} else {
+	if orderId == "" || sellerData == "" {
 		c.Errorf("invalid jwt: %v", *token)
-		http.Error(w, "invalid jwt", http.StatusInternalServerError)
+		return badRequest("invalid_jwt", "invalid jwt")
 	}
+
+	err = processCoinOrder(c, orderId, sellerData)
+	if err != nil {
+		c.Errorf("error processing jwt: %v", *token)
+		return asKindiError(err, "error processing jwt")
+	}
+	fmt.Fprint(w, orderId)
+	return nil
 }
 
-func promoHandler(c appengine.Context, u *user.User, w http.ResponseWriter, r *http.Request) {
+func (s *server) promoHandler(c appengine.Context, u *user.User, w http.ResponseWriter, r *http.Request) error {
+	promo := s.config.Promo.Code
 	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
 	q := datastore.NewQuery("KindiOrder").Ancestor(accountKey).Filter("OrderId=", promo)
 	n, err := q.Count(c)
 	if err != nil {
-		c.Errorf("error processing promo: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return internalError("error processing promo", err)
 	}
 	if n > 0 {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		fmt.Fprint(w, "promo used")
-		return
+		return conflict("promo_used", "promo used")
 	}
 
-	q = datastore.NewQuery("KindiPromo").Filter("Code=", promo)
-	n, err = q.Count(c)
+	err = seedPromoCounter(c, promo)
 	if err != nil {
-		c.Errorf("error processing promo: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return internalError("error processing promo", err)
 	}
 
-	if n > promoCount {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		fmt.Fprint(w, "promo expired")
-		return
-	}
+	expired := false
+	counterKey := datastore.NewKey(c, "KindiPromoCounter", promo, 0, nil)
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var counter KindiPromoCounter
+		err := datastore.Get(c, counterKey, &counter)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		expired = counter.Count > s.config.Promo.Count
+		if expired {
+			return nil
+		}
 
-	promoKey := datastore.NewIncompleteKey(c, "KindiPromo", nil)
-	promoValue := &KindiPromo {
-		Code: promo,
-	}
-	_, err = datastore.Put(c, promoKey, promoValue)
+		counter.Count++
+		_, err = datastore.Put(c, counterKey, &counter)
+		if err != nil {
+			return err
+		}
+		promoKey := datastore.NewIncompleteKey(c, "KindiPromo", counterKey)
+		_, err = datastore.Put(c, promoKey, &KindiPromo{Code: promo})
+		return err
+	}, nil)
 	if err != nil {
-		c.Errorf("error processing promo: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return asKindiError(err, "error processing promo")
+	}
+	if expired {
+		return conflict("promo_expired", "promo expired")
 	}
 
 	err = processCoins(c, promo, u.ID, 1)
 	if err != nil {
-		c.Errorf("error processing promo: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return asKindiError(err, "error processing promo")
 	}
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	fmt.Fprint(w, "promo accepted")
-	return
+	return nil
 }
 
-func jotHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	u := user.Current(c)
+func (s *server) jotHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
 	if u == nil {
-		http.Error(w, "no user", http.StatusInternalServerError)
-		return
+		return errNoUser
 	}
 
 	promoStr := r.FormValue("promo")
-	if promoStr == promo {
-		promoHandler(c, u, w, r)
-		return
+	if promoStr != "" && promoStr == s.config.Promo.Code {
+		return s.promoHandler(c, u, w, r)
 	}
 
 	quantityStr := r.FormValue("quantity")
@@ -216,44 +221,95 @@ func jotHandler(w http.ResponseWriter, r *http.Request) {
 
 	quantity, err := strconv.Atoi(quantityStr)
 	if err != nil {
-		c.Errorf("error parsing quantity: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return newError(http.StatusBadRequest, "invalid_quantity", "invalid quantity", err)
 	}
 
 	if quantity < 1 || quantity > 5 {
-		c.Errorf("invalid quantity: %v", quantity)
-		http.Error(w, "invalid quantity", http.StatusInternalServerError)
-		return
+		return badRequest("invalid_quantity", "invalid quantity")
 	}
 
 	sellerData := fmt.Sprintf("userId:%s,quantity:%d", u.ID, quantity)
 
 	request := map[string]string{
-		"name":         "......",
-		"description":  ".......",
+		"name":         s.config.Seller.ItemName,
+		"description":  s.config.Seller.ItemDescription,
 		"price":        quantityStr,
-		"currencyCode": "......",
+		"currencyCode": s.config.Seller.CurrencyCode,
 		"sellerData":   sellerData,
 	}
 
+	sellerSecret, err := s.secrets.Secret(c, s.config.Seller.SecretName)
+	if err != nil {
+		return internalError("error reading seller secret", err)
+	}
+
 	issued := time.Now()
 
 	token := jwt.Token{
 		Request:          request,
 		Issued:           issued,
 		Expires:          issued.Add(time.Hour),
-		SellerIdentifier: sellerIdentifier,
+		SellerIdentifier: s.config.Seller.Identifier,
 		SellerSecret:     sellerSecret,
 	}
 
 	jot, err := jwt.Encode(token)
 	if err != nil {
-		c.Errorf("error encoding jwt: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return internalError("error encoding jwt", err)
 	}
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	fmt.Fprint(w, jot)
+	return nil
+}
+
+// recomputePromoCounters raises the counter of the configured promo code,
+// or the one in the code parameter, to the number of redemptions stored.
+func (s *server) recomputePromoCounters(c appengine.Context, params url.Values) error {
+	code := params.Get("code")
+	if code == "" {
+		code = s.config.Promo.Code
+	}
+	if code == "" {
+		return nil
+	}
+	return recountPromo(c, code)
+}
+
+// recountPromo counts the redemptions of code, including those stored
+// before there was a counter, without a parent. The count comes from an
+// index that may lag behind, so the counter is only ever raised; lowering
+// it could undo redemptions made since.
+func recountPromo(c appengine.Context, code string) error {
+	n, err := datastore.NewQuery("KindiPromo").Filter("Code=", code).Count(c)
+	if err != nil {
+		return err
+	}
+
+	counterKey := datastore.NewKey(c, "KindiPromoCounter", code, 0, nil)
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var counter KindiPromoCounter
+		err := datastore.Get(c, counterKey, &counter)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == nil && counter.Count >= n {
+			return nil
+		}
+		c.Infof("promo %s counted %d redemptions, found %d", code, counter.Count, n)
+		counter.Count = n
+		_, err = datastore.Put(c, counterKey, &counter)
+		return err
+	}, nil)
+}
+
+// seedPromoCounter recounts the redemptions of code if it has no counter
+// yet, as the first time it is used after upgrading.
+func seedPromoCounter(c appengine.Context, code string) error {
+	counterKey := datastore.NewKey(c, "KindiPromoCounter", code, 0, nil)
+	err := datastore.Get(c, counterKey, &KindiPromoCounter{})
+	if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	return recountPromo(c, code)
 }
@@ -0,0 +1,523 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"appengine/user"
+
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/uwedeportivo/shared/util"
+)
+
+// Algorithms of bare public keys.
+const (
+	algX25519    = "X25519"
+	algECDHP256  = "ECDH-P256"
+	algMLKEM768  = "ML-KEM-768"
+	algMLKEM1024 = "ML-KEM-1024"
+	algEd25519   = "Ed25519"
+)
+
+var (
+	oidX25519    = asn1.ObjectIdentifier{1, 3, 101, 110}
+	oidMLKEM768  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 4, 2}
+	oidMLKEM1024 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 4, 3}
+)
+
+// keyAlgorithmCapabilities are the capabilities of each bare key
+// algorithm. Bare keys are published for mail, so all of them serve
+// emailProtection.
+var keyAlgorithmCapabilities = map[string][]string{
+	algX25519:    {capKeyAgreement, capEmailProtection},
+	algECDHP256:  {capKeyAgreement, capEmailProtection},
+	algMLKEM768:  {capKeyEncapsulation, capEmailProtection},
+	algMLKEM1024: {capKeyEncapsulation, capEmailProtection},
+	algEd25519:   {capDigitalSignature, capEmailProtection},
+}
+
+// KindiKey is a bare public key published for Email. It is a child of
+// the owner's KindiAccount. Description is the JSON keyDescription kindi
+// issued for it and Signature kindi's Ed25519 signature over it. Like a
+// certificate it is published under the owner's verified addresses, or
+// just the chosen Addresses.
+type KindiKey struct {
+	ID          string
+	Email       string
+	Name        string
+	Algorithm   string
+	KeyBytes    []byte `datastore:",noindex"`
+	Processed   time.Time
+	Expires     time.Time
+	Description []byte `datastore:",noindex"`
+	Signature   []byte `datastore:",noindex"`
+	// Flagged is why a re-scan found the key compromised. Flagged keys
+	// are not returned by lookups.
+	Flagged string `datastore:",noindex"`
+	// Addresses are the owner's addresses the key is published under,
+	// see publishedUnder. Empty means all of them.
+	Addresses []string
+}
+
+// live reports whether lookups return key at t.
+func (key *KindiKey) live(t time.Time) bool {
+	return key.Flagged == "" && key.Expires.After(t)
+}
+
+func (key *KindiKey) servesPurpose(purpose string) bool {
+	return capabilitiesServe(keyAlgorithmCapabilities[key.Algorithm], purpose)
+}
+
+// keyDescription is kindi's statement that the key with KeyID, the hex
+// SHA-256 of its SubjectPublicKeyInfo, belongs to Email, and to the
+// Addresses the owner chose for it if any. Clients check it against the
+// issuer key at /rpc/v1/issuer.
+type keyDescription struct {
+	Issuer       string    `json:"issuer"`
+	Email        string    `json:"email"`
+	Addresses    []string  `json:"addresses,omitempty"`
+	Algorithm    string    `json:"algorithm"`
+	KeyID        string    `json:"keyId"`
+	Capabilities []string  `json:"capabilities"`
+	Issued       time.Time `json:"issued"`
+	Expires      time.Time `json:"expires"`
+}
+
+// keyEntry is how a bare key is shown to its owner.
+type keyEntry struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Email       string    `json:"email"`
+	Algorithm   string    `json:"algorithm"`
+	Processed   time.Time `json:"processed"`
+	Expires     time.Time `json:"expires"`
+	Description []byte    `json:"description"`
+	Signature   []byte    `json:"signature"`
+	Flagged     string    `json:"flagged,omitempty"`
+	Addresses   []string  `json:"addresses,omitempty"`
+}
+
+func newKeyEntry(key *KindiKey) keyEntry {
+	return keyEntry{
+		ID:          key.ID,
+		Name:        key.Name,
+		Email:       key.Email,
+		Algorithm:   key.Algorithm,
+		Processed:   key.Processed,
+		Expires:     key.Expires,
+		Description: key.Description,
+		Signature:   key.Signature,
+		Flagged:     key.Flagged,
+		Addresses:   key.Addresses,
+	}
+}
+
+// publishedUnder reports whether key is returned for address, given the
+// verified addresses of its owner, like KindiCertificate.publishedUnder.
+func (key *KindiKey) publishedUnder(address string, owned []string) bool {
+	if len(key.Addresses) > 0 {
+		return hasAddress(key.Addresses, address)
+	}
+	return key.Email == address || hasAddress(owned, address)
+}
+
+// keysFor returns the bare keys published under the canonical address,
+// like certificatesFor.
+func keysFor(c appengine.Context, address string) ([]KindiKey, []*datastore.Key, error) {
+	pubKeys := make([]KindiKey, 0)
+	keys, err := datastore.NewQuery("KindiKey").Filter("Email=", address).GetAll(c, &pubKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := make([]KindiKey, 0, len(pubKeys))
+	rkeys := make([]*datastore.Key, 0, len(keys))
+	seen := make(map[string]bool)
+	for i := range pubKeys {
+		seen[keys[i].Encode()] = true
+		if pubKeys[i].publishedUnder(address, nil) {
+			r = append(r, pubKeys[i])
+			rkeys = append(rkeys, keys[i])
+		}
+	}
+
+	owners, err := addressOwners(c, address)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, owner := range owners {
+		accountKey := datastore.NewKey(c, "KindiAccount", owner, 0, nil)
+		owned := make([]KindiKey, 0)
+		ownedKeys, err := datastore.NewQuery("KindiKey").Ancestor(accountKey).GetAll(c, &owned)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range owned {
+			if seen[ownedKeys[i].Encode()] || !owned[i].publishedUnder(address, []string{address}) {
+				continue
+			}
+			seen[ownedKeys[i].Encode()] = true
+			r = append(r, owned[i])
+			rkeys = append(rkeys, ownedKeys[i])
+		}
+	}
+	return r, rkeys, nil
+}
+
+// decodePublicKeyPEM returns the DER SubjectPublicKeyInfo of the first
+// PEM block in data, or the problem that kept it from being a public key.
+func decodePublicKeyPEM(data []byte) ([]byte, *lintProblem) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, &lintProblem{"invalid_pem", severityError, "no PEM block found, paste the text starting with -----BEGIN PUBLIC KEY-----"}
+	}
+	if strings.Contains(block.Type, "PRIVATE KEY") {
+		return nil, &lintProblem{"private_key", severityError, "this is a private key, never share it; paste the public key instead"}
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, &lintProblem{"invalid_pem", severityError, fmt.Sprintf("PEM block is a %s, not a PUBLIC KEY", block.Type)}
+	}
+	return block.Bytes, nil
+}
+
+// publicKeyAlgorithm checks that der is a SubjectPublicKeyInfo of one of
+// the bare key algorithms and returns which.
+func publicKeyAlgorithm(der []byte) (string, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	rest, err := asn1.Unmarshal(der, &spki)
+	if err != nil {
+		return "", err
+	}
+	if len(rest) > 0 {
+		return "", errors.New("trailing data after public key")
+	}
+
+	// ML-KEM keys are not known to crypto/x509 yet, and the packages
+	// that check ML-KEM and X25519 keys need a newer runtime, see
+	// parseEncryptionKey.
+	switch oid := spki.Algorithm.Algorithm; {
+	case oid.Equal(oidX25519), oid.Equal(oidMLKEM768), oid.Equal(oidMLKEM1024):
+		if len(spki.Algorithm.Parameters.FullBytes) > 0 {
+			return "", errors.New("unexpected algorithm parameters")
+		}
+		return parseEncryptionKey(oid, spki.PublicKey.RightAlign())
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return "", err
+	}
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		// ParsePKIXPublicKey has checked that the point is on the curve.
+		if key.Curve == elliptic.P256() {
+			return algECDHP256, nil
+		}
+	case ed25519.PublicKey:
+		return algEd25519, nil
+	}
+	return "", errors.New("only X25519, P-256, ML-KEM-768, ML-KEM-1024 and Ed25519 keys are accepted")
+}
+
+// issuerKey is the Ed25519 key kindi signs key descriptions with, derived
+// from the configured secret.
+func (s *server) issuerKey(c appengine.Context) (ed25519.PrivateKey, error) {
+	secret, err := s.secrets.Secret(c, s.config.Keys.IssuerSecretName)
+	if err != nil {
+		return nil, err
+	}
+	seed := sha256.Sum256([]byte(secret))
+	return ed25519.NewKeyFromSeed(seed[:]), nil
+}
+
+// describeKey issues and signs the description of key.
+func (s *server) describeKey(c appengine.Context, key *KindiKey) error {
+	priv, err := s.issuerKey(c)
+	if err != nil {
+		return err
+	}
+	return s.describeKeyWith(c, priv, key)
+}
+
+// describeKeyWith is describeKey with the issuer key read beforehand, so
+// that it can run in a transaction.
+func (s *server) describeKeyWith(c appengine.Context, priv ed25519.PrivateKey, key *KindiKey) error {
+	keyID := sha256.Sum256(key.KeyBytes)
+	desc, err := json.Marshal(keyDescription{
+		Issuer:       s.jobBaseURL(c),
+		Email:        key.Email,
+		Addresses:    key.Addresses,
+		Algorithm:    key.Algorithm,
+		KeyID:        hex.EncodeToString(keyID[:]),
+		Capabilities: keyAlgorithmCapabilities[key.Algorithm],
+		Issued:       key.Processed,
+		Expires:      key.Expires,
+	})
+	if err != nil {
+		return err
+	}
+	key.Description = desc
+	key.Signature = ed25519.Sign(priv, desc)
+	return nil
+}
+
+// storeKey publishes the DER encoded public key for u under name,
+// charging one kindi coin like a certificate.
+func (s *server) storeKey(c appengine.Context, u *user.User, name string, der []byte) (*KindiKey, error) {
+	if name == "" {
+		name = "Untitled"
+	}
+
+	alg, err := publicKeyAlgorithm(der)
+	if err != nil {
+		return nil, newError(http.StatusBadRequest, "invalid_key", "public key cannot be used: "+err.Error(), err)
+	}
+	if s.keys.spkiBlocked(der) {
+		return nil, errRejected([]lintProblem{{"compromised_key", severityError, "key is on the list of known compromised keys"}})
+	}
+
+	now := time.Now()
+	key := KindiKey{
+		ID:        util.UUID(),
+		Email:     s.canonical(u.Email),
+		Name:      name,
+		Algorithm: alg,
+		KeyBytes:  der,
+		Processed: now,
+		Expires:   now.AddDate(1, 0, 0),
+	}
+	err = s.describeKey(c, &key)
+	if err != nil {
+		return nil, internalError("error describing key", err)
+	}
+
+	account, err := getAccount(c, u.ID)
+	if err != nil {
+		return nil, asKindiError(err, "error retrieving account")
+	}
+
+	if account.KindiCoins <= 0 {
+		return nil, errNoCoins
+	}
+
+	account.KindiCoins -= 1
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	keyKey := datastore.NewKey(c, "KindiKey", key.ID, 0, accountKey)
+
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		_, err := datastore.Put(c, accountKey, account)
+		if err != nil {
+			return err
+		}
+
+		_, err = datastore.Put(c, keyKey, &key)
+		if err != nil {
+			return err
+		}
+
+		memcacheItem := &memcache.Item{
+			Key:    u.ID,
+			Object: *account,
+		}
+		return memcache.JSON.Set(c, memcacheItem)
+	}, nil)
+
+	if err != nil {
+		return nil, asKindiError(err, "error saving key")
+	}
+	return &key, nil
+}
+
+// keyUploadHandler publishes a bare public key given in PEM as key.
+func (s *server) keyUploadHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	keyStr := r.FormValue("key")
+	if keyStr == "" {
+		return badRequest("no_key", "no key")
+	}
+
+	der, problem := decodePublicKeyPEM([]byte(keyStr))
+	if problem != nil {
+		return badRequest(problem.Code, problem.Message)
+	}
+
+	key, err := s.storeKey(c, u, r.FormValue("name"), der)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(newKeyEntry(key))
+	if err != nil {
+		return internalError("error marshalling key", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+	return nil
+}
+
+// keysHandler lists the current user's bare keys.
+func (s *server) keysHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	keys := make([]KindiKey, 0)
+	_, err := datastore.NewQuery("KindiKey").Ancestor(accountKey).GetAll(c, &keys)
+	if err != nil {
+		return internalError("error reading keys", err)
+	}
+
+	entries := make([]keyEntry, len(keys))
+	for i := range keys {
+		entries[i] = newKeyEntry(&keys[i])
+	}
+
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return internalError("error marshalling keys", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+	return nil
+}
+
+func (s *server) keyDeleteHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		return badRequest("no_key", "no key id given")
+	}
+
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	err := datastore.Delete(c, datastore.NewKey(c, "KindiKey", id, 0, accountKey))
+	if err != nil {
+		return internalError("error deleting key", err)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, "ok")
+	return nil
+}
+
+// keyAddressesHandler chooses the verified addresses, given as
+// addresses[], the key id is published under, and describes the key
+// anew with them.
+func (s *server) keyAddressesHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		return newError(http.StatusBadRequest, "bad_form", "error parsing form", err)
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		return badRequest("no_key", "no key id given")
+	}
+	chosen := make([]string, 0, len(r.Form["addresses[]"]))
+	for _, a := range r.Form["addresses[]"] {
+		if a = s.canonical(a); !hasAddress(chosen, a) {
+			chosen = append(chosen, a)
+		}
+	}
+	if len(chosen) == 0 {
+		return badRequest("no_addresses", "choose at least one address")
+	}
+
+	owned, err := s.accountAddresses(c, u)
+	if err != nil {
+		return internalError("error reading addresses", err)
+	}
+	for _, a := range chosen {
+		if !hasAddress(owned, a) {
+			return badRequest("unverified_address", a+" is not a verified address of your account")
+		}
+	}
+
+	priv, err := s.issuerKey(c)
+	if err != nil {
+		return internalError("error reading issuer key", err)
+	}
+
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	keyKey := datastore.NewKey(c, "KindiKey", id, 0, accountKey)
+	var pubKey KindiKey
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		err := datastore.Get(c, keyKey, &pubKey)
+		if err == datastore.ErrNoSuchEntity {
+			return notFound("no_key", "no such key")
+		}
+		if err != nil {
+			return err
+		}
+
+		pubKey.Addresses = chosen
+		err = s.describeKeyWith(c, priv, &pubKey)
+		if err != nil {
+			return err
+		}
+		_, err = datastore.Put(c, keyKey, &pubKey)
+		return err
+	}, nil)
+	if err != nil {
+		return asKindiError(err, "error saving key")
+	}
+
+	body, err := json.Marshal(newKeyEntry(&pubKey))
+	if err != nil {
+		return internalError("error marshalling key", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+	return nil
+}
+
+// issuerHandler sends the public key that key descriptions are signed
+// with.
+func (s *server) issuerHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	priv, err := s.issuerKey(c)
+	if err != nil {
+		return internalError("error reading issuer key", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		return internalError("error encoding issuer key", err)
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	pem.Encode(w, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	return nil
+}
@@ -0,0 +1,28 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+//go:build go1.24
+// +build go1.24
+
+package kindi
+
+import (
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"encoding/asn1"
+)
+
+// parseEncryptionKey checks that key is a public key of oid, which is
+// X25519, ML-KEM-768 or ML-KEM-1024, and returns the algorithm.
+func parseEncryptionKey(oid asn1.ObjectIdentifier, key []byte) (string, error) {
+	var err error
+	switch {
+	case oid.Equal(oidX25519):
+		_, err = ecdh.X25519().NewPublicKey(key)
+		return algX25519, err
+	case oid.Equal(oidMLKEM768):
+		_, err = mlkem.NewEncapsulationKey768(key)
+		return algMLKEM768, err
+	}
+	_, err = mlkem.NewEncapsulationKey1024(key)
+	return algMLKEM1024, err
+}
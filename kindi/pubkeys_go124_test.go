@@ -0,0 +1,40 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+//go:build go1.24
+// +build go1.24
+
+package kindi
+
+import (
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"crypto/rand"
+	"testing"
+)
+
+func TestEncryptionKeyAlgorithm(t *testing.T) {
+	x25519, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mlkem768, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mlkem1024, err := mlkem.GenerateKey1024()
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := x25519.PublicKey().Bytes()
+	ek768 := mlkem768.EncapsulationKey().Bytes()
+
+	checkPublicKeyAlgorithms(t, []keyAlgorithmTest{
+		{"x25519", marshalPKIX(t, x25519.PublicKey()), algX25519},
+		{"raw x25519", rawSPKI(t, oidX25519, x), algX25519},
+		{"short x25519 key", rawSPKI(t, oidX25519, x[:len(x)-1]), ""},
+		{"ml-kem-768", rawSPKI(t, oidMLKEM768, ek768), algMLKEM768},
+		{"ml-kem-1024", rawSPKI(t, oidMLKEM1024, mlkem1024.EncapsulationKey().Bytes()), algMLKEM1024},
+		{"ml-kem-768 key as 1024", rawSPKI(t, oidMLKEM1024, ek768), ""},
+		{"short ml-kem-768 key", rawSPKI(t, oidMLKEM768, ek768[:len(ek768)-1]), ""},
+	})
+}
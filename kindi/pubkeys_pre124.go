@@ -0,0 +1,18 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+//go:build !go1.24
+// +build !go1.24
+
+package kindi
+
+import (
+	"encoding/asn1"
+	"errors"
+)
+
+// parseEncryptionKey refuses X25519 and ML-KEM keys: the runtime has no
+// crypto/ecdh or crypto/mlkem to check them with. Builds with Go 1.24 or
+// later accept them.
+func parseEncryptionKey(oid asn1.ObjectIdentifier, key []byte) (string, error) {
+	return "", errors.New("X25519 and ML-KEM keys are not accepted by this server")
+}
@@ -0,0 +1,19 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+//go:build !go1.24
+// +build !go1.24
+
+package kindi
+
+import (
+	"testing"
+)
+
+func TestEncryptionKeyAlgorithm(t *testing.T) {
+	key := make([]byte, 32)
+	checkPublicKeyAlgorithms(t, []keyAlgorithmTest{
+		{"x25519", rawSPKI(t, oidX25519, key), ""},
+		{"ml-kem-768", rawSPKI(t, oidMLKEM768, key), ""},
+		{"ml-kem-1024", rawSPKI(t, oidMLKEM1024, key), ""},
+	})
+}
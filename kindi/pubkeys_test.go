@@ -0,0 +1,121 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"testing"
+)
+
+// rawSPKI wraps key as a SubjectPublicKeyInfo of algorithm oid, the way
+// crypto/x509 would if it knew the algorithm.
+func rawSPKI(t *testing.T, oid asn1.ObjectIdentifier, key []byte) []byte {
+	der, err := asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{pkix.AlgorithmIdentifier{Algorithm: oid}, asn1.BitString{Bytes: key, BitLength: 8 * len(key)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// marshalPKIX is x509.MarshalPKIXPublicKey for tests.
+func marshalPKIX(t *testing.T, pub interface{}) []byte {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+type keyAlgorithmTest struct {
+	name string
+	der  []byte
+	// want is the algorithm, or empty if the key is refused.
+	want string
+}
+
+func checkPublicKeyAlgorithms(t *testing.T, tests []keyAlgorithmTest) {
+	for _, tt := range tests {
+		got, err := publicKeyAlgorithm(tt.der)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("%s: accepted as %s, want an error", tt.name, got)
+		case tt.want != "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.want != "" && got != tt.want:
+			t.Errorf("%s: algorithm %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPublicKeyAlgorithm(t *testing.T) {
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshal := func(pub interface{}) []byte {
+		return marshalPKIX(t, pub)
+	}
+
+	checkPublicKeyAlgorithms(t, []keyAlgorithmTest{
+		{"p256", marshal(&p256.PublicKey), algECDHP256},
+		{"ed25519", marshal(edPub), algEd25519},
+		{"p384", marshal(&p384.PublicKey), ""},
+		{"rsa", marshal(&rsaKey.PublicKey), ""},
+		{"trailing data", append(marshal(edPub), 0), ""},
+		{"not der", []byte("-----BEGIN PUBLIC KEY-----"), ""},
+	})
+}
+
+func TestDecodePublicKeyPEM(t *testing.T) {
+	block := func(typ string) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: []byte{1, 2, 3}})
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		// want is the problem code, or empty if the key decodes.
+		want string
+	}{
+		{"public key", block("PUBLIC KEY"), ""},
+		{"public key after text", append([]byte("my key:\n"), block("PUBLIC KEY")...), ""},
+		{"private key", block("PRIVATE KEY"), "private_key"},
+		{"ec private key", block("EC PRIVATE KEY"), "private_key"},
+		{"certificate", block("CERTIFICATE"), "invalid_pem"},
+		{"no pem", []byte("MCowBQYDK2VwAyEA"), "invalid_pem"},
+	}
+	for _, tt := range tests {
+		der, problem := decodePublicKeyPEM(tt.data)
+		switch {
+		case tt.want == "" && problem != nil:
+			t.Errorf("%s: %s", tt.name, problem.Message)
+		case tt.want == "" && string(der) != "\x01\x02\x03":
+			t.Errorf("%s: got %x, want the block's bytes", tt.name, der)
+		case tt.want != "" && (problem == nil || problem.Code != tt.want):
+			t.Errorf("%s: got problem %v, want %s", tt.name, problem, tt.want)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/memcache"
+
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// rateLimit counts one more event for key in the current window and
+// reports whether the count is still within limit. Counters live in
+// memcache; losing one to eviction lets a few extra events through,
+// which is acceptable for abuse limits.
+func rateLimit(c appengine.Context, key string, limit int, window time.Duration) (bool, error) {
+	bucket := time.Now().UnixNano() / int64(window)
+	n, err := memcache.Increment(c, fmt.Sprintf("rate-%s-%d", key, bucket), 1, 0)
+	if err != nil {
+		return false, err
+	}
+	return n <= uint64(limit), nil
+}
+
+// errRateLimited tells the client to come back once the current window
+// is over.
+func errRateLimited(message string, window time.Duration) *kindiError {
+	now := time.Now().UnixNano()
+	err := newError(http.StatusTooManyRequests, "rate_limited", message, nil)
+	err.RetryAfter = time.Duration(int64(window) - now%int64(window))
+	return err
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"appengine/user"
+
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sendExpiryReminders mails the owners of certificates that entered one of
+// the reminder windows since the last run. A certificate is reminded
+// about at most once per window.
+func (s *server) sendExpiryReminders(c appengine.Context, params url.Values) error {
+	days := append([]int(nil), s.config.Reminders.Days...)
+	if len(days) == 0 {
+		return nil
+	}
+	sort.Ints(days)
+
+	now := time.Now()
+	certs := make([]KindiCertificate, 0)
+	q := datastore.NewQuery("KindiCertificate").Filter("Expires>", now).Filter("Expires<=", now.AddDate(0, 0, days[len(days)-1]))
+	keys, err := q.GetAll(c, &certs)
+	if err != nil {
+		return err
+	}
+
+	for i, cert := range certs {
+		window := 0
+		for _, d := range days {
+			if !cert.Expires.After(now.AddDate(0, 0, d)) {
+				window = d
+				break
+			}
+		}
+		if cert.RemindedDays != 0 && cert.RemindedDays <= window {
+			continue
+		}
+		if cert.SupersededBy != "" {
+			continue
+		}
+
+		accountKey := keys[i].Parent()
+		if accountKey == nil {
+			continue
+		}
+		account, err := getAccount(c, accountKey.StringID())
+		if err == datastore.ErrNoSuchEntity {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if account.NoReminders {
+			continue
+		}
+
+		renewed, err := hasLaterCertificate(c, accountKey, &cert)
+		if err != nil {
+			return err
+		}
+		if renewed {
+			continue
+		}
+
+		// Recording the reminder before sending keeps a retried run from
+		// sending it twice; sendMail keeps failed mail for retrying.
+		send := false
+		err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+			var current KindiCertificate
+			err := datastore.Get(c, keys[i], &current)
+			if err != nil {
+				return err
+			}
+			if current.RemindedDays != 0 && current.RemindedDays <= window {
+				return nil
+			}
+			current.RemindedDays = window
+			_, err = datastore.Put(c, keys[i], &current)
+			send = err == nil
+			return err
+		}, nil)
+		if err == datastore.ErrNoSuchEntity {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !send {
+			continue
+		}
+
+		err = memcache.Delete(c, accountKey.StringID()+"-certs")
+		if err != nil && err != memcache.ErrCacheMiss {
+			c.Warningf("error invalidating certificates of %s: %v", accountKey.StringID(), err)
+		}
+
+		s.sendMail(c, s.expiryReminder(c, &cert, now))
+	}
+	return nil
+}
+
+// hasLaterCertificate reports whether the account already published a
+// certificate for cert's email that expires after cert.
+func hasLaterCertificate(c appengine.Context, accountKey *datastore.Key, cert *KindiCertificate) (bool, error) {
+	certs := make([]KindiCertificate, 0)
+	_, err := datastore.NewQuery("KindiCertificate").Ancestor(accountKey).GetAll(c, &certs)
+	if err != nil {
+		return false, err
+	}
+	for _, other := range certs {
+		if other.ID != cert.ID && other.Email == cert.Email && other.Expires.After(cert.Expires) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *server) expiryReminder(c appengine.Context, cert *KindiCertificate, now time.Time) *Message {
+	left := int((cert.Expires.Sub(now) + 24*time.Hour - 1) / (24 * time.Hour))
+	when := fmt.Sprintf("in %d days", left)
+	if left == 1 {
+		when = "tomorrow"
+	}
+
+	base := s.jobBaseURL(c)
+	return &Message{
+		To:      []string{cert.Email},
+		Subject: fmt.Sprintf("Your kindi certificate %q expires %s", cert.Name, when),
+		Body: fmt.Sprintf("Your kindi certificate %q for %s expires %s, on %s.\n"+
+			"After that nobody can look it up to send you encrypted files.\n\n"+
+			"Upload a renewed certificate here:\n%s\n\n"+
+			"You can turn these reminders off on %s\n",
+			cert.Name, cert.Email, when, cert.Expires.Format("January 2, 2006"),
+			base+"/manage?renew="+url.QueryEscape(cert.ID), base+"/manage"),
+	}
+}
+
+// jobBaseURL is the base URL for links in mail sent outside a request.
+func (s *server) jobBaseURL(c appengine.Context) string {
+	if s.config.BaseURL != "" {
+		return strings.TrimRight(s.config.BaseURL, "/")
+	}
+	return "https://" + appengine.DefaultVersionHostname(c)
+}
+
+// remindersHandler turns expiry reminders on or off for the account.
+func (s *server) remindersHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	var enabled bool
+	switch r.FormValue("reminders") {
+	case "on":
+		enabled = true
+	case "off":
+	default:
+		return badRequest("bad_reminders", "reminders must be on or off")
+	}
+
+	err := setReminders(c, u, enabled)
+	if err != nil {
+		return asKindiError(err, "error saving account")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, "ok")
+	return nil
+}
+
+func setReminders(c appengine.Context, u *user.User, enabled bool) error {
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	return datastore.RunInTransaction(c, func(c appengine.Context) error {
+		var account KindiAccount
+		err := datastore.Get(c, accountKey, &account)
+		if err != nil {
+			return err
+		}
+		account.NoReminders = !enabled
+		_, err = datastore.Put(c, accountKey, &account)
+		if err != nil {
+			return err
+		}
+		return memcache.JSON.Set(c, &memcache.Item{
+			Key:    u.ID,
+			Object: account,
+		})
+	}, nil)
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// KindiRenewal records that certificate NewID superseded OldID. It is a
+// child of the owner's KindiAccount, keyed by NewID, and outlives both
+// certificates so the chain of renewals stays known.
+type KindiRenewal struct {
+	OldID   string
+	OldName string
+	NewID   string
+	NewName string
+	Renewed time.Time
+	Retires time.Time
+}
+
+type historyEntry struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	SupersededBy string     `json:"supersededBy,omitempty"`
+	Renewed      *time.Time `json:"renewed,omitempty"`
+	Retires      *time.Time `json:"retires,omitempty"`
+}
+
+// supersede makes cert the renewal of the account's certificate oldID. The
+// old certificate stays in lookups as outgoing for the configured overlap.
+// It must run in a transaction on the account's entity group.
+func (s *server) supersede(c appengine.Context, accountKey *datastore.Key, oldID string, cert *KindiCertificate) error {
+	oldKey := datastore.NewKey(c, "KindiCertificate", oldID, 0, accountKey)
+
+	var old KindiCertificate
+	err := datastore.Get(c, oldKey, &old)
+	if err == datastore.ErrNoSuchEntity {
+		return notFound("no_certificate", "no such certificate to renew")
+	}
+	if err != nil {
+		return err
+	}
+	if old.SupersededBy != "" {
+		return conflict("already_renewed", "certificate was already renewed")
+	}
+
+	now := time.Now()
+	old.SupersededBy = cert.ID
+	old.Retires = earlier(now.Add(s.config.Renewals.Overlap.Duration), old.Expires)
+	cert.Supersedes = old.ID
+	// The renewal takes over as primary.
+	cert.PrimaryFor = old.PrimaryFor
+	old.PrimaryFor = nil
+
+	_, err = datastore.Put(c, oldKey, &old)
+	if err != nil {
+		return err
+	}
+
+	renewal := KindiRenewal{
+		OldID:   old.ID,
+		OldName: old.Name,
+		NewID:   cert.ID,
+		NewName: cert.Name,
+		Renewed: now,
+		Retires: old.Retires,
+	}
+	_, err = datastore.Put(c, datastore.NewKey(c, "KindiRenewal", cert.ID, 0, accountKey), &renewal)
+	return err
+}
+
+// retireCertificates ends the overlap of renewed certificates: once they
+// retire, they expire, so everything else treats them as expired too.
+func (s *server) retireCertificates(c appengine.Context, params url.Values) error {
+	certs := make([]KindiCertificate, 0)
+	q := datastore.NewQuery("KindiCertificate").Filter("Retires>", time.Unix(0, 0)).Filter("Retires<=", time.Now())
+	keys, err := q.GetAll(c, &certs)
+	if err != nil {
+		return err
+	}
+
+	for i := range certs {
+		cert := &certs[i]
+		if !cert.Expires.After(cert.Retires) {
+			continue
+		}
+		cert.Expires = cert.Retires
+		_, err = datastore.Put(c, keys[i], cert)
+		if err != nil {
+			return err
+		}
+		err = memcache.Delete(c, keys[i].Parent().StringID()+"-certs")
+		if err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+	}
+	return nil
+}
+
+// historyHandler returns the chain of renewals the certificate id is part
+// of, oldest first.
+func (s *server) historyHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		return badRequest("no_certificate", "no certificate id given")
+	}
+
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	renewals := make([]KindiRenewal, 0)
+	_, err := datastore.NewQuery("KindiRenewal").Ancestor(accountKey).GetAll(c, &renewals)
+	if err != nil {
+		return internalError("error reading renewals", err)
+	}
+
+	byOld := make(map[string]*KindiRenewal)
+	byNew := make(map[string]*KindiRenewal)
+	for i := range renewals {
+		byOld[renewals[i].OldID] = &renewals[i]
+		byNew[renewals[i].NewID] = &renewals[i]
+	}
+
+	var cert KindiCertificate
+	err = datastore.Get(c, datastore.NewKey(c, "KindiCertificate", id, 0, accountKey), &cert)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return internalError("error reading certificate", err)
+	}
+	if err == datastore.ErrNoSuchEntity && byOld[id] == nil && byNew[id] == nil {
+		return notFound("no_certificate", "no such certificate")
+	}
+
+	// Walk back to the first certificate, then forward along the chain.
+	first, name := id, cert.Name
+	for seen := map[string]bool{id: true}; byNew[first] != nil && !seen[byNew[first].OldID]; {
+		first, name = byNew[first].OldID, byNew[first].OldName
+		seen[first] = true
+	}
+
+	chain := make([]historyEntry, 0)
+	for current, seen := first, make(map[string]bool); !seen[current]; {
+		seen[current] = true
+		entry := historyEntry{ID: current, Name: name}
+		renewal := byOld[current]
+		if renewal == nil {
+			chain = append(chain, entry)
+			break
+		}
+		renewed, retires := renewal.Renewed, renewal.Retires
+		entry.SupersededBy = renewal.NewID
+		entry.Renewed = &renewed
+		entry.Retires = &retires
+		chain = append(chain, entry)
+		current, name = renewal.NewID, renewal.NewName
+	}
+
+	body, err := json.Marshal(chain)
+	if err != nil {
+		return internalError("error marshalling history", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+	return nil
+}
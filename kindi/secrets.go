@@ -0,0 +1,127 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretProvider hands out named secrets. Implementations must pick up a
+// rotated value within a bounded time so that secrets can change without
+// a redeploy.
+type SecretProvider interface {
+	Secret(c appengine.Context, name string) (string, error)
+}
+
+func newSecretProvider(cfg SecretsConfig) SecretProvider {
+	switch cfg.Provider {
+	case "file":
+		return &fileSecretProvider{dir: cfg.Dir, ttl: cfg.TTL.Duration}
+	case "env":
+		return envSecretProvider{}
+	}
+	return &datastoreSecretProvider{ttl: cfg.TTL.Duration}
+}
+
+// KindiSecret holds a secret value keyed by its name. Rotating a secret
+// means overwriting the entity; memcache copies expire after the
+// configured TTL.
+type KindiSecret struct {
+	Value   string `datastore:",noindex"`
+	Updated time.Time
+}
+
+type datastoreSecretProvider struct {
+	ttl time.Duration
+}
+
+func (p *datastoreSecretProvider) Secret(c appengine.Context, name string) (string, error) {
+	cacheKey := "secret-" + name
+
+	var secret KindiSecret
+	_, err := memcache.JSON.Get(c, cacheKey, &secret)
+	if err != nil && err != memcache.ErrCacheMiss {
+		return "", err
+	}
+
+	if err == memcache.ErrCacheMiss {
+		key := datastore.NewKey(c, "KindiSecret", name, 0, nil)
+		err = datastore.Get(c, key, &secret)
+		if err == datastore.ErrNoSuchEntity {
+			return "", fmt.Errorf("secret %q not found", name)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		memcacheItem := &memcache.Item{
+			Key:        cacheKey,
+			Object:     secret,
+			Expiration: p.ttl,
+		}
+		err = memcache.JSON.Set(c, memcacheItem)
+		if err != nil {
+			return "", err
+		}
+	}
+	return secret.Value, nil
+}
+
+type cachedSecret struct {
+	value   string
+	fetched time.Time
+}
+
+// fileSecretProvider reads each secret from a file named after it in dir
+// and rereads it once the TTL has passed. Meant for the dev server.
+type fileSecretProvider struct {
+	dir string
+	ttl time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedSecret
+}
+
+func (p *fileSecretProvider) Secret(c appengine.Context, name string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if s, ok := p.cache[name]; ok && now.Sub(s.fetched) < p.ttl {
+		return s.value, nil
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(p.dir, name))
+	if err != nil {
+		return "", fmt.Errorf("secret %q: %v", name, err)
+	}
+
+	if p.cache == nil {
+		p.cache = make(map[string]cachedSecret)
+	}
+	value := strings.TrimSpace(string(data))
+	p.cache[name] = cachedSecret{value: value, fetched: now}
+	return value, nil
+}
+
+// envSecretProvider reads secret "seller-secret" from KINDI_SECRET_SELLER_SECRET.
+type envSecretProvider struct{}
+
+func (envSecretProvider) Secret(c appengine.Context, name string) (string, error) {
+	envName := "KINDI_SECRET_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+	value := os.Getenv(envName)
+	if value == "" {
+		return "", fmt.Errorf("secret %q: %s not set", name, envName)
+	}
+	return value, nil
+}
@@ -0,0 +1,405 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	_ "crypto/sha1"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+var (
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidEmailAddress  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+	oidSHA1          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+var errNotSigned = errors.New("smime: message is not signed")
+
+// smimeSignature is a checked signature.
+type smimeSignature struct {
+	signer *x509.Certificate
+	// content is the signed MIME entity.
+	content []byte
+	// digest is the SHA-256 of the bytes the signature covers: the
+	// signed attributes if there are any, which mail clients fill with
+	// the signing time, or else content. It tells one signing of a
+	// message from another, and cannot be changed without the key.
+	digest [sha256.Size]byte
+}
+
+// The PKCS #7 (RFC 2315) structures needed to check a signature. Only
+// DER is understood, which is what mail clients send for signed mail.
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type attribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+// verifySMIME checks the S/MIME signature of msg, either a
+// multipart/signed message or opaque signed-data. The certificate it was
+// signed with has to chain to roots and be meant for email protection.
+func verifySMIME(msg *mail.Message, body []byte, roots *x509.CertPool) (*smimeSignature, error) {
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, errNotSigned
+	}
+
+	switch mediaType {
+	case "multipart/signed":
+		parts, err := splitMultipart(canonicalLines(body), params["boundary"])
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) != 2 {
+			return nil, errors.New("smime: multipart/signed needs two parts")
+		}
+		header, sig, err := readPart(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		sigType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+		if !isPKCS7(sigType) {
+			return nil, errNotSigned
+		}
+		return verifyPKCS7(sig, parts[0], roots)
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		if params["smime-type"] != "" && params["smime-type"] != "signed-data" {
+			return nil, errNotSigned
+		}
+		der, err := decodeBody(msg.Header.Get("Content-Transfer-Encoding"), body)
+		if err != nil {
+			return nil, err
+		}
+		return verifyPKCS7(der, nil, roots)
+	}
+	return nil, errNotSigned
+}
+
+func isPKCS7(mediaType string) bool {
+	return mediaType == "application/pkcs7-signature" || mediaType == "application/x-pkcs7-signature"
+}
+
+// canonicalLines turns every line ending into CRLF, the form the
+// signature was computed over.
+func canonicalLines(b []byte) []byte {
+	b = bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(b, []byte("\n"), []byte("\r\n"), -1)
+}
+
+// splitMultipart returns the raw parts of a multipart body, headers
+// included. mime/multipart cannot be used because the signed part has to
+// be checked byte for byte.
+func splitMultipart(body []byte, boundary string) ([][]byte, error) {
+	if boundary == "" {
+		return nil, errors.New("smime: multipart without boundary")
+	}
+	chunks := bytes.Split(append([]byte("\r\n"), body...), []byte("\r\n--"+boundary))
+
+	parts := make([][]byte, 0, 2)
+	for _, chunk := range chunks[1:] {
+		if bytes.HasPrefix(chunk, []byte("--")) {
+			return parts, nil
+		}
+		i := bytes.Index(chunk, []byte("\r\n"))
+		if i < 0 {
+			return nil, errors.New("smime: malformed multipart")
+		}
+		parts = append(parts, chunk[i+2:])
+	}
+	return nil, errors.New("smime: unterminated multipart")
+}
+
+func readPart(part []byte) (textproto.MIMEHeader, []byte, error) {
+	tr := textproto.NewReader(bufio.NewReader(bytes.NewReader(part)))
+	header, err := tr.ReadMIMEHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	rest, err := ioutil.ReadAll(tr.R)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := decodeBody(header.Get("Content-Transfer-Encoding"), rest)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, body, nil
+}
+
+// signedText returns the decoded text parts of the MIME entity, one after
+// the other.
+func signedText(entity []byte) ([]byte, error) {
+	header, body, err := readPart(canonicalLines(entity))
+	if err != nil {
+		return nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// Without a usable Content-Type, RFC 2045 has it plain text.
+		mediaType = "text/plain"
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return body, nil
+	case strings.HasPrefix(mediaType, "multipart/"):
+		parts, err := splitMultipart(canonicalLines(body), params["boundary"])
+		if err != nil {
+			return nil, err
+		}
+		text := make([]byte, 0, len(body))
+		for _, part := range parts {
+			t, err := signedText(part)
+			if err != nil {
+				return nil, err
+			}
+			text = append(append(text, t...), '\n')
+		}
+		return text, nil
+	}
+	return nil, nil
+}
+
+func decodeBody(encoding string, body []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, body)
+		return base64.StdEncoding.DecodeString(string(clean))
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	}
+	return body, nil
+}
+
+// verifyPKCS7 checks the single signature in the DER encoded SignedData
+// over detached, or over the content embedded in it if detached is nil,
+// and returns it once the signer's certificate chains to roots. The other
+// certificates in the SignedData serve as intermediates.
+func verifyPKCS7(der, detached []byte, roots *x509.CertPool) (*smimeSignature, error) {
+	var ci contentInfo
+	_, err := asn1.Unmarshal(der, &ci)
+	if err != nil {
+		return nil, fmt.Errorf("smime: %v", err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, errNotSigned
+	}
+
+	var sd signedData
+	_, err = asn1.Unmarshal(ci.Content.Bytes, &sd)
+	if err != nil {
+		return nil, fmt.Errorf("smime: %v", err)
+	}
+
+	content := detached
+	if content == nil {
+		_, err = asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &content)
+		if err != nil {
+			return nil, fmt.Errorf("smime: no signed content: %v", err)
+		}
+	}
+
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("smime: want one signer, got %d", len(sd.SignerInfos))
+	}
+	si := sd.SignerInfos[0]
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("smime: %v", err)
+	}
+	var signer *x509.Certificate
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs {
+		if signer == nil && bytes.Equal(cert.RawIssuer, si.IssuerAndSerialNumber.Issuer.FullBytes) &&
+			cert.SerialNumber.Cmp(si.IssuerAndSerialNumber.Serial) == 0 {
+			signer = cert
+			continue
+		}
+		intermediates.AddCert(cert)
+	}
+	if signer == nil {
+		return nil, errors.New("smime: signer certificate not included")
+	}
+
+	hash, err := digestHash(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	sigAlg, err := signatureAlgorithm(signer, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := content
+	if len(si.AuthenticatedAttributes.FullBytes) > 0 {
+		// The signature covers the attributes, DER encoded as a SET, and
+		// the messageDigest attribute covers the content.
+		signed = append([]byte(nil), si.AuthenticatedAttributes.FullBytes...)
+		signed[0] = 0x31
+
+		var attrs []attribute
+		_, err = asn1.UnmarshalWithParams(signed, &attrs, "set")
+		if err != nil {
+			return nil, fmt.Errorf("smime: %v", err)
+		}
+		var digest []byte
+		for _, attr := range attrs {
+			if attr.Type.Equal(oidMessageDigest) {
+				_, err = asn1.Unmarshal(attr.Value.Bytes, &digest)
+				if err != nil {
+					return nil, fmt.Errorf("smime: %v", err)
+				}
+			}
+		}
+		h := hash.New()
+		h.Write(content)
+		if digest == nil || !bytes.Equal(digest, h.Sum(nil)) {
+			return nil, errors.New("smime: message digest mismatch")
+		}
+	}
+
+	err = signer.CheckSignature(sigAlg, signed, si.EncryptedDigest)
+	if err != nil {
+		return nil, fmt.Errorf("smime: %v", err)
+	}
+
+	// Anybody can sign with a certificate they made up for somebody else's
+	// address, so the signature alone proves nothing about the sender.
+	if roots == nil {
+		return nil, errors.New("smime: no trusted roots")
+	}
+	_, err = signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("smime: %v", err)
+	}
+	return &smimeSignature{signer: signer, content: content, digest: sha256.Sum256(signed)}, nil
+}
+
+// loadCertPool reads the PEM certificates in path. An empty path gives a
+// nil pool.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no certificates", path)
+	}
+	return pool, nil
+}
+
+func digestHash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return crypto.SHA1, nil
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("smime: unsupported digest algorithm %v", oid)
+}
+
+func signatureAlgorithm(cert *x509.Certificate, hash crypto.Hash) (x509.SignatureAlgorithm, error) {
+	algs := map[x509.PublicKeyAlgorithm]map[crypto.Hash]x509.SignatureAlgorithm{
+		x509.RSA: {
+			crypto.SHA1:   x509.SHA1WithRSA,
+			crypto.SHA256: x509.SHA256WithRSA,
+			crypto.SHA384: x509.SHA384WithRSA,
+			crypto.SHA512: x509.SHA512WithRSA,
+		},
+		x509.ECDSA: {
+			crypto.SHA1:   x509.ECDSAWithSHA1,
+			crypto.SHA256: x509.ECDSAWithSHA256,
+			crypto.SHA384: x509.ECDSAWithSHA384,
+			crypto.SHA512: x509.ECDSAWithSHA512,
+		},
+	}
+	if alg, ok := algs[cert.PublicKeyAlgorithm][hash]; ok {
+		return alg, nil
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("smime: unsupported %v key", cert.PublicKeyAlgorithm)
+}
+
+// certHasEmail reports whether cert is issued to email, either in its
+// subject alternative names or in the subject's emailAddress.
+func certHasEmail(cert *x509.Certificate, email string) bool {
+	for _, e := range cert.EmailAddresses {
+		if strings.EqualFold(e, email) {
+			return true
+		}
+	}
+	for _, name := range cert.Subject.Names {
+		if name.Type.Equal(oidEmailAddress) {
+			if s, ok := name.Value.(string); ok && strings.EqualFold(s, email) {
+				return true
+			}
+		}
+	}
+	return false
+}
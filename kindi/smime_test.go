@@ -0,0 +1,290 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+var oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+
+type testIdentity struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+var testSerial int64
+
+// newTestIdentity makes a certificate from template signed by parent, or
+// self-signed if parent is nil.
+func newTestIdentity(t *testing.T, template *x509.Certificate, parent *testIdentity) *testIdentity {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	template.SerialNumber = big.NewInt(testSerial)
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(24 * time.Hour)
+	}
+	issuer, signer := template, key
+	if parent != nil {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIdentity{cert, key}
+}
+
+func testCA(t *testing.T, name string, parent *testIdentity) *testIdentity {
+	return newTestIdentity(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, parent)
+}
+
+func testLeaf(t *testing.T, email string, usage x509.ExtKeyUsage, parent *testIdentity) *testIdentity {
+	return newTestIdentity(t, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: email},
+		EmailAddresses: []string{email},
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{usage},
+	}, parent)
+}
+
+// signPKCS7 signs content as signer and returns the DER SignedData with
+// certs included. The content is embedded unless detached, and signed
+// through a messageDigest attribute if attrs.
+func signPKCS7(t *testing.T, signer *testIdentity, certs []*x509.Certificate, content []byte, detached, attrs bool) []byte {
+	mustMarshal := func(v interface{}, params string) []byte {
+		b, err := asn1.MarshalWithParams(v, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	digest := crypto.SHA256.New()
+	digest.Write(content)
+
+	si := signerInfo{
+		Version: 1,
+		IssuerAndSerialNumber: issuerAndSerial{
+			Issuer: asn1.RawValue{FullBytes: signer.cert.RawIssuer},
+			Serial: signer.cert.SerialNumber,
+		},
+		DigestAlgorithm:           pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+		DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256},
+	}
+	signed := content
+	if attrs {
+		set := mustMarshal([]attribute{{
+			Type:  oidMessageDigest,
+			Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: mustMarshal(digest.Sum(nil), "")},
+		}}, "set")
+		signed = set
+		implicit := append([]byte{0xa0}, set[1:]...)
+		si.AuthenticatedAttributes = asn1.RawValue{FullBytes: implicit}
+	}
+	h := crypto.SHA256.New()
+	h.Write(signed)
+	sig, err := ecdsa.SignASN1(rand.Reader, signer.key, h.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	si.EncryptedDigest = sig
+
+	var raw []byte
+	for _, cert := range certs {
+		raw = append(raw, cert.Raw...)
+	}
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+		ContentInfo:      contentInfo{ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw},
+		SignerInfos:      []signerInfo{si},
+	}
+	if !detached {
+		sd.ContentInfo.Content = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: mustMarshal(content, "")}
+	}
+	return mustMarshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: mustMarshal(sd, "")},
+	}, "")
+}
+
+func TestVerifyPKCS7(t *testing.T) {
+	root := testCA(t, "kindi test root", nil)
+	intermediate := testCA(t, "kindi test intermediate", root)
+	alice := testLeaf(t, "alice@example.com", x509.ExtKeyUsageEmailProtection, root)
+	bob := testLeaf(t, "bob@example.com", x509.ExtKeyUsageEmailProtection, intermediate)
+	server := testLeaf(t, "alice@example.com", x509.ExtKeyUsageServerAuth, root)
+
+	// A forger can make any certificate for alice, even under a CA named
+	// like the real one, and sign with it.
+	forged := testLeaf(t, "alice@example.com", x509.ExtKeyUsageEmailProtection, nil)
+	fakeRoot := testCA(t, "kindi test root", nil)
+	forgedUnderFake := testLeaf(t, "alice@example.com", x509.ExtKeyUsageEmailProtection, fakeRoot)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+
+	content := []byte("Content-Type: text/plain\r\n\r\nhello\r\n")
+	tests := []struct {
+		name     string
+		der      []byte
+		detached []byte
+		roots    *x509.CertPool
+		want     *x509.Certificate
+	}{
+		{"detached", signPKCS7(t, alice, []*x509.Certificate{alice.cert}, content, true, false), content, roots, alice.cert},
+		{"embedded", signPKCS7(t, alice, []*x509.Certificate{alice.cert}, content, false, false), nil, roots, alice.cert},
+		{"attributes", signPKCS7(t, alice, []*x509.Certificate{alice.cert}, content, true, true), content, roots, alice.cert},
+		{"intermediate included", signPKCS7(t, bob, []*x509.Certificate{bob.cert, intermediate.cert}, content, true, false), content, roots, bob.cert},
+		{"intermediate missing", signPKCS7(t, bob, []*x509.Certificate{bob.cert}, content, true, false), content, roots, nil},
+		{"self-signed forgery", signPKCS7(t, forged, []*x509.Certificate{forged.cert}, content, true, false), content, roots, nil},
+		{"forgery under look-alike root", signPKCS7(t, forgedUnderFake, []*x509.Certificate{forgedUnderFake.cert, fakeRoot.cert}, content, true, false), content, roots, nil},
+		{"not for email protection", signPKCS7(t, server, []*x509.Certificate{server.cert}, content, true, false), content, roots, nil},
+		{"no roots", signPKCS7(t, alice, []*x509.Certificate{alice.cert}, content, true, false), content, nil, nil},
+		{"altered content", signPKCS7(t, alice, []*x509.Certificate{alice.cert}, content, true, false), []byte("Content-Type: text/plain\r\n\r\nhullo\r\n"), roots, nil},
+		{"altered attributed content", signPKCS7(t, alice, []*x509.Certificate{alice.cert}, content, true, true), []byte("hullo"), roots, nil},
+		{"signer not included", signPKCS7(t, alice, []*x509.Certificate{bob.cert}, content, true, false), content, roots, nil},
+		{"not signed data", []byte{0x30, 0x03, 0x02, 0x01, 0x01}, content, roots, nil},
+	}
+	for _, tt := range tests {
+		got, err := verifyPKCS7(tt.der, tt.detached, tt.roots)
+		switch {
+		case tt.want == nil && err == nil:
+			t.Errorf("%s: verified, want an error", tt.name)
+		case tt.want != nil && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.want != nil && !got.signer.Equal(tt.want):
+			t.Errorf("%s: signer %s, want %s", tt.name, got.signer.Subject, tt.want.Subject)
+		case tt.want != nil && !bytes.Equal(got.content, content):
+			t.Errorf("%s: content %q, want %q", tt.name, got.content, content)
+		}
+	}
+}
+
+func TestVerifySMIME(t *testing.T) {
+	root := testCA(t, "kindi test root", nil)
+	alice := testLeaf(t, "alice@example.com", x509.ExtKeyUsageEmailProtection, root)
+	forged := testLeaf(t, "alice@example.com", x509.ExtKeyUsageEmailProtection, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+
+	part := []byte("Content-Type: text/plain\r\n\r\nplease publish my certificate")
+	signedMail := func(signer *testIdentity) string {
+		sig := base64.StdEncoding.EncodeToString(signPKCS7(t, signer, []*x509.Certificate{signer.cert}, part, true, true))
+		return "From: alice@example.com\n" +
+			"Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=sha-256; boundary=b\n" +
+			"\n" +
+			"--b\n" + strings.Replace(string(part), "\r\n", "\n", -1) + "\n" +
+			"--b\n" +
+			"Content-Type: application/pkcs7-signature; name=smime.p7s\n" +
+			"Content-Transfer-Encoding: base64\n" +
+			"\n" + sig + "\n" +
+			"--b--\n"
+	}
+
+	tests := []struct {
+		name string
+		msg  string
+		want *x509.Certificate
+	}{
+		{"signed", signedMail(alice), alice.cert},
+		{"forged", signedMail(forged), nil},
+		{"unsigned", "From: alice@example.com\nContent-Type: text/plain\n\nhello\n", nil},
+	}
+	for _, tt := range tests {
+		msg, err := mail.ReadMessage(strings.NewReader(tt.msg))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		body := new(bytes.Buffer)
+		body.ReadFrom(msg.Body)
+		got, err := verifySMIME(msg, body.Bytes(), roots)
+		switch {
+		case tt.want == nil && err == nil:
+			t.Errorf("%s: verified, want an error", tt.name)
+		case tt.want != nil && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.want != nil && !got.signer.Equal(tt.want):
+			t.Errorf("%s: signer %s, want %s", tt.name, got.signer.Subject, tt.want.Subject)
+		}
+	}
+}
+
+func TestSignatureDigest(t *testing.T) {
+	root := testCA(t, "kindi test root", nil)
+	alice := testLeaf(t, "alice@example.com", x509.ExtKeyUsageEmailProtection, root)
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+
+	digest := func(content []byte, attrs bool) [32]byte {
+		sig, err := verifyPKCS7(signPKCS7(t, alice, []*x509.Certificate{alice.cert}, content, true, attrs), content, roots)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig.digest
+	}
+
+	// ECDSA signatures differ every time, so a replay could not be told
+	// by them.
+	hello, hullo := []byte("hello"), []byte("hullo")
+	for _, attrs := range []bool{false, true} {
+		if digest(hello, attrs) != digest(hello, attrs) {
+			t.Errorf("attributes %v: two signatures of the same content have different digests", attrs)
+		}
+		if digest(hello, attrs) == digest(hullo, attrs) {
+			t.Errorf("attributes %v: signatures of different content have the same digest", attrs)
+		}
+	}
+}
+
+func TestSignedText(t *testing.T) {
+	tests := []struct {
+		name   string
+		entity string
+		want   string
+	}{
+		{"plain", "Content-Type: text/plain\r\n\r\ncode kindi-0123", "code kindi-0123"},
+		{"no content type", "\r\ncode kindi-0123", "code kindi-0123"},
+		{"quoted-printable", "Content-Type: text/plain\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\ncode kindi-=\r\n0123", "code kindi-0123"},
+		{"base64", "Content-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\nY29kZSBraW5kaS0wMTIz", "code kindi-0123"},
+		{"attachment only", "Content-Type: application/octet-stream\r\n\r\nkindi-0123", ""},
+		{"alternative", "Content-Type: multipart/alternative; boundary=b\n\n--b\nContent-Type: text/plain\n\nkindi-0123\n--b\nContent-Type: text/html\n\n<p>kindi-0123</p>\n--b--\n", "kindi-0123\n<p>kindi-0123</p>\n"},
+	}
+	for _, tt := range tests {
+		got, err := signedText([]byte(tt.entity))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
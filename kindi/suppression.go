@@ -0,0 +1,147 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	suppressUnsubscribe = "unsubscribe"
+	suppressBounce      = "bounce"
+)
+
+var unsubscribeTmpl *template.Template
+
+func init() {
+	unsubscribeTmpl = template.Must(template.ParseFiles("tmpl/unsubscribe.html"))
+}
+
+// KindiSuppression keeps an address from receiving invites. It is keyed
+// by the canonical address.
+type KindiSuppression struct {
+	Email   string
+	Reason  string
+	Created time.Time
+}
+
+type UnsubscribeTmplData struct {
+	Email        string
+	Signature    string
+	Unsubscribed bool
+}
+
+func suppressionKey(c appengine.Context, email string) *datastore.Key {
+	return datastore.NewKey(c, "KindiSuppression", email, 0, nil)
+}
+
+func isSuppressed(c appengine.Context, email string) (bool, error) {
+	var suppression KindiSuppression
+	err := datastore.Get(c, suppressionKey(c, email), &suppression)
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func suppress(c appengine.Context, email, reason string) error {
+	suppression := KindiSuppression{
+		Email:   email,
+		Reason:  reason,
+		Created: time.Now(),
+	}
+	_, err := datastore.Put(c, suppressionKey(c, email), &suppression)
+	return err
+}
+
+func unsubscribeMAC(key, email string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("unsubscribe|" + strings.ToLower(email)))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// unsubscribeURL is the link put into every invite for its recipient.
+func (s *server) unsubscribeURL(c appengine.Context, base, email string) (string, error) {
+	key, err := s.secrets.Secret(c, s.config.Invites.SecretName)
+	if err != nil {
+		return "", err
+	}
+	values := url.Values{}
+	values.Set("e", email)
+	values.Set("s", unsubscribeMAC(key, email))
+	return base + "/unsubscribe?" + values.Encode(), nil
+}
+
+// unsubscribeHandler needs no login since recipients usually have no
+// kindi account; the signature on the link proves the address. GET only
+// asks for confirmation so that link scanners don't unsubscribe anybody.
+func (s *server) unsubscribeHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	email := r.FormValue("e")
+	sig := r.FormValue("s")
+
+	key, err := s.secrets.Secret(c, s.config.Invites.SecretName)
+	if err != nil {
+		return internalError("error reading invite key", err)
+	}
+	if email == "" || !hmac.Equal([]byte(unsubscribeMAC(key, email)), []byte(sig)) {
+		return badRequest("bad_unsubscribe", "invalid unsubscribe link")
+	}
+
+	data := UnsubscribeTmplData{
+		Email:     email,
+		Signature: sig,
+	}
+
+	if r.Method == "POST" {
+		err = suppress(c, s.canonical(email), suppressUnsubscribe)
+		if err != nil {
+			return internalError("error unsubscribing", err)
+		}
+		data.Unsubscribed = true
+	}
+
+	err = unsubscribeTmpl.Execute(w, data)
+	if err != nil {
+		return internalError("error rendering page", err)
+	}
+	return nil
+}
+
+// bounceHandler receives App Engine bounce notifications and suppresses
+// the addresses that bounced.
+func (s *server) bounceHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	to := r.FormValue("original-to")
+	if to == "" {
+		c.Warningf("bounce notification without original-to")
+		return nil
+	}
+
+	addrs, err := mail.ParseAddressList(to)
+	if err != nil {
+		c.Warningf("error parsing bounced address %q: %v", to, err)
+		return nil
+	}
+
+	for _, addr := range addrs {
+		c.Infof("suppressing bounced address %s", addr.Address)
+		err = suppress(c, s.canonical(addr.Address), suppressBounce)
+		if err != nil {
+			return internalError("error suppressing bounced address", err)
+		}
+	}
+	return nil
+}
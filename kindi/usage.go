@@ -0,0 +1,146 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+)
+
+// Key capabilities recorded on a KindiCertificate.
+const (
+	capKeyEncipherment  = "keyEncipherment"
+	capKeyAgreement     = "keyAgreement"
+	capDigitalSignature = "digitalSignature"
+	capEmailProtection  = "emailProtection"
+	// capKeyEncapsulation is what ML-KEM keys do, only bare keys have it.
+	capKeyEncapsulation = "keyEncapsulation"
+)
+
+// lookupPurposes are the purposes /rpc/v1 can filter by, with the key
+// usages any one of which serves it.
+var lookupPurposes = map[string][]string{
+	"encrypt": {capKeyEncipherment, capKeyAgreement, capKeyEncapsulation},
+	"sign":    {capDigitalSignature},
+}
+
+// keyCapabilities lists what cert's key may be used for. A certificate
+// without a key usage extension may be used for whatever its key type
+// can do, and one without an extended key usage for anything.
+func keyCapabilities(cert *x509.Certificate) []string {
+	ku := cert.KeyUsage
+	if ku == 0 {
+		switch cert.PublicKey.(type) {
+		case *rsa.PublicKey:
+			ku = x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+		case *ecdsa.PublicKey:
+			ku = x509.KeyUsageKeyAgreement | x509.KeyUsageDigitalSignature
+		case ed25519.PublicKey:
+			ku = x509.KeyUsageDigitalSignature
+		}
+	}
+
+	r := make([]string, 0, 4)
+	if ku&x509.KeyUsageKeyEncipherment != 0 {
+		r = append(r, capKeyEncipherment)
+	}
+	if ku&x509.KeyUsageKeyAgreement != 0 {
+		r = append(r, capKeyAgreement)
+	}
+	if ku&(x509.KeyUsageDigitalSignature|x509.KeyUsageContentCommitment) != 0 {
+		r = append(r, capDigitalSignature)
+	}
+	if hasEmailProtection(cert) || len(cert.ExtKeyUsage) == 0 && len(cert.UnknownExtKeyUsage) == 0 {
+		r = append(r, capEmailProtection)
+	}
+	return r
+}
+
+func hasEmailProtection(cert *x509.Certificate) bool {
+	for _, eku := range cert.ExtKeyUsage {
+		if eku == x509.ExtKeyUsageEmailProtection || eku == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+// capabilities returns the recorded capabilities of cert, working them
+// out from its bytes for certificates stored before they were recorded.
+func (cert *KindiCertificate) capabilities() []string {
+	if len(cert.Capabilities) > 0 {
+		return cert.Capabilities
+	}
+	x509Cert, err := x509.ParseCertificate(cert.CertBytes)
+	if err != nil {
+		return nil
+	}
+	return keyCapabilities(x509Cert)
+}
+
+// servesPurpose reports whether cert can be used for purpose, one of
+// lookupPurposes. Any certificate serves the empty purpose.
+func (cert *KindiCertificate) servesPurpose(purpose string) bool {
+	return capabilitiesServe(cert.capabilities(), purpose)
+}
+
+// capabilitiesServe reports whether a key with capabilities can protect
+// mail for purpose.
+func capabilitiesServe(capabilities []string, purpose string) bool {
+	if purpose == "" {
+		return true
+	}
+	caps := make(map[string]bool)
+	for _, c := range capabilities {
+		caps[c] = true
+	}
+	if !caps[capEmailProtection] {
+		return false
+	}
+	for _, c := range lookupPurposes[purpose] {
+		if caps[c] {
+			return true
+		}
+	}
+	return false
+}
+
+// lintUsage checks cert's key usages against the configured policy.
+// Violations are errors when the policy requires the usage and warnings
+// otherwise.
+func (s *server) lintUsage(cert *x509.Certificate) []lintProblem {
+	policy := s.config.Usage
+	problems := make([]lintProblem, 0)
+
+	severity := severityWarning
+	if policy.RequireEncryption {
+		severity = severityError
+	}
+	if cert.KeyUsage != 0 && cert.KeyUsage&(x509.KeyUsageKeyEncipherment|x509.KeyUsageKeyAgreement) == 0 {
+		problems = append(problems, lintProblem{"no_encryption_usage", severity,
+			"key usage allows neither keyEncipherment nor keyAgreement, nobody can encrypt to it"})
+	}
+	if _, ok := cert.PublicKey.(ed25519.PublicKey); ok {
+		problems = append(problems, lintProblem{"signing_key", severity,
+			"Ed25519 keys can only sign, nobody can encrypt to them"})
+	}
+
+	severity = severityWarning
+	if policy.RequireEmailProtection {
+		severity = severityError
+	}
+	switch {
+	case hasEmailProtection(cert):
+	case len(cert.ExtKeyUsage) == 0 && len(cert.UnknownExtKeyUsage) == 0:
+		if !policy.AllowMissingExtKeyUsage {
+			problems = append(problems, lintProblem{"no_ext_key_usage", severity,
+				"certificate has no extended key usage, mail clients want emailProtection"})
+		}
+	default:
+		problems = append(problems, lintProblem{"no_email_protection", severity,
+			"extended key usage does not include emailProtection, this is not a mail certificate"})
+	}
+	return problems
+}
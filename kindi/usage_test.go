@@ -0,0 +1,71 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"strings"
+	"testing"
+)
+
+func TestKeyCapabilities(t *testing.T) {
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub := &rsa.PublicKey{N: p256.X, E: 65537}
+	email := []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection}
+
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want string
+	}{
+		{"rsa without usages", &x509.Certificate{PublicKey: rsaPub}, "keyEncipherment digitalSignature emailProtection"},
+		{"ec without usages", &x509.Certificate{PublicKey: &p256.PublicKey}, "keyAgreement digitalSignature emailProtection"},
+		{"ed25519 without usages", &x509.Certificate{PublicKey: edPub}, "digitalSignature emailProtection"},
+		{"encryption only", &x509.Certificate{PublicKey: rsaPub, KeyUsage: x509.KeyUsageKeyEncipherment, ExtKeyUsage: email}, "keyEncipherment emailProtection"},
+		{"non-repudiation signs", &x509.Certificate{PublicKey: rsaPub, KeyUsage: x509.KeyUsageContentCommitment, ExtKeyUsage: email}, "digitalSignature emailProtection"},
+		{"any ext key usage", &x509.Certificate{PublicKey: &p256.PublicKey, KeyUsage: x509.KeyUsageKeyAgreement, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}, "keyAgreement emailProtection"},
+		{"server certificate", &x509.Certificate{PublicKey: rsaPub, KeyUsage: x509.KeyUsageKeyEncipherment, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, "keyEncipherment"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(keyCapabilities(tt.cert), " "); got != tt.want {
+			t.Errorf("%s: keyCapabilities = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestServesPurpose(t *testing.T) {
+	tests := []struct {
+		capabilities []string
+		purpose      string
+		want         bool
+	}{
+		{[]string{capKeyEncipherment, capEmailProtection}, "", true},
+		{[]string{capKeyEncipherment, capEmailProtection}, "encrypt", true},
+		{[]string{capKeyAgreement, capEmailProtection}, "encrypt", true},
+		{[]string{capKeyEncipherment, capEmailProtection}, "sign", false},
+		{[]string{capDigitalSignature, capEmailProtection}, "sign", true},
+		{[]string{capDigitalSignature, capEmailProtection}, "encrypt", false},
+		// Without emailProtection a certificate serves no mail purpose.
+		{[]string{capKeyEncipherment, capDigitalSignature}, "encrypt", false},
+		{[]string{capKeyEncipherment, capDigitalSignature}, "sign", false},
+		{[]string{capKeyEncipherment, capDigitalSignature}, "", true},
+	}
+	for _, tt := range tests {
+		cert := &KindiCertificate{Capabilities: tt.capabilities}
+		if got := cert.servesPurpose(tt.purpose); got != tt.want {
+			t.Errorf("servesPurpose(%q) with %v = %v, want %v", tt.purpose, tt.capabilities, got, tt.want)
+		}
+	}
+}
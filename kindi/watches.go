@@ -0,0 +1,266 @@
+// Copyright (c) 2012 Uwe Hoffmann. All rights reserved.
+
+package kindi
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"appengine/urlfetch"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uwedeportivo/shared/util"
+)
+
+// KindiWatch asks to be told when a certificate for Email is published.
+// It is a child of the watcher's KindiAccount. Watches fire once and are
+// deleted afterwards.
+type KindiWatch struct {
+	ID           string
+	Email        string
+	WatcherEmail string
+	Webhook      string `datastore:",noindex"`
+	Created      time.Time
+	Expires      time.Time
+}
+
+type watchResult struct {
+	Watching  []string `json:"watching"`
+	Published []string `json:"published"`
+}
+
+type watchEvent struct {
+	Event string `json:"event"`
+	Email string `json:"email"`
+}
+
+var notifyWatchersLater *delay.Function
+
+func getUserWatches(c appengine.Context, userId string) ([]KindiWatch, error) {
+	accountKey := datastore.NewKey(c, "KindiAccount", userId, 0, nil)
+
+	watches := make([]KindiWatch, 0)
+	_, err := datastore.NewQuery("KindiWatch").Ancestor(accountKey).GetAll(c, &watches)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	r := make([]KindiWatch, 0, len(watches))
+	for _, watch := range watches {
+		if watch.Expires.After(now) {
+			r = append(r, watch)
+		}
+	}
+	return r, nil
+}
+
+// hasValidCertificate reports whether a currently valid certificate is
+// published for the canonical email.
+func hasValidCertificate(c appengine.Context, email string) (bool, error) {
+	certs, _, err := certificatesFor(c, email)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	for _, cert := range certs {
+		if cert.live(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// watchHandler registers watches for the comma separated emails. Emails
+// that already have a certificate are reported back instead.
+func (s *server) watchHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	emailStr := r.FormValue("emails")
+	if emailStr == "" {
+		return badRequest("no_emails", "no emails given")
+	}
+
+	webhook := r.FormValue("webhook")
+	if webhook != "" {
+		hookURL, err := url.Parse(webhook)
+		if err != nil || hookURL.Scheme != "https" || hookURL.Host == "" {
+			return badRequest("bad_webhook", "webhook must be an https URL")
+		}
+	}
+
+	ttl := s.config.Watches.TTL.Duration
+	if days := r.FormValue("days"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 {
+			return badRequest("bad_days", "days must be a positive number")
+		}
+		ttl = time.Duration(n) * 24 * time.Hour
+		if ttl > s.config.Watches.MaxTTL.Duration {
+			ttl = s.config.Watches.MaxTTL.Duration
+		}
+	}
+
+	emails := make([]string, 0)
+	for _, email := range strings.Split(emailStr, ",") {
+		if strings.TrimSpace(email) == "" {
+			continue
+		}
+		canonical, err := s.canonicalEmail(email)
+		if err != nil {
+			return badRequest("bad_email", fmt.Sprintf("%q is not an email address", strings.TrimSpace(email)))
+		}
+		if !hasAddress(emails, canonical) {
+			emails = append(emails, canonical)
+		}
+	}
+
+	now := time.Now()
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	result := watchResult{
+		Watching:  make([]string, 0),
+		Published: make([]string, 0),
+	}
+
+	for _, email := range emails {
+		published, err := hasValidCertificate(c, email)
+		if err != nil {
+			return internalError("error fetching certs", err)
+		}
+		if published {
+			result.Published = append(result.Published, email)
+			continue
+		}
+
+		watch := KindiWatch{
+			ID:           util.UUID(),
+			Email:        email,
+			WatcherEmail: u.Email,
+			Webhook:      webhook,
+			Created:      now,
+			Expires:      now.Add(ttl),
+		}
+		_, err = datastore.Put(c, datastore.NewKey(c, "KindiWatch", watch.ID, 0, accountKey), &watch)
+		if err != nil {
+			return internalError("error saving watch", err)
+		}
+		result.Watching = append(result.Watching, email)
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return internalError("error marshalling watches", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+	return nil
+}
+
+// cancelWatchHandler deletes the watches given in watches[].
+func (s *server) cancelWatchHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) error {
+	u := currentUser(c, r)
+	if u == nil {
+		return errNoUser
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		return newError(http.StatusBadRequest, "bad_form", "error parsing form", err)
+	}
+
+	watchIDs := r.Form["watches[]"]
+	if len(watchIDs) == 0 {
+		return badRequest("no_watches", "no watch IDs found")
+	}
+
+	accountKey := datastore.NewKey(c, "KindiAccount", u.ID, 0, nil)
+	keys := make([]*datastore.Key, len(watchIDs))
+	for i, id := range watchIDs {
+		keys[i] = datastore.NewKey(c, "KindiWatch", id, 0, accountKey)
+	}
+
+	err = datastore.DeleteMulti(c, keys)
+	if err != nil {
+		return internalError("error deleting watches", err)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, "ok")
+	return nil
+}
+
+// notifyWatchers tells everyone watching email that a certificate was
+// published for it. Delivered watches are deleted, expired ones are
+// dropped silently.
+func (s *server) notifyWatchers(c appengine.Context, email string) error {
+	watches := make([]KindiWatch, 0)
+	keys, err := datastore.NewQuery("KindiWatch").Filter("Email=", email).GetAll(c, &watches)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	done := make([]*datastore.Key, 0, len(keys))
+	var lastErr error
+
+	for i, watch := range watches {
+		if watch.Expires.After(now) {
+			if watch.Webhook != "" {
+				err = s.callWebhook(c, watch.Webhook, email)
+				if err != nil {
+					c.Errorf("error notifying %s about %s: %v", watch.Webhook, email, err)
+					lastErr = err
+					continue
+				}
+			} else {
+				s.sendMail(c, &Message{
+					To:      []string{watch.WatcherEmail},
+					Subject: "A kindi certificate was published for " + email,
+					Body: fmt.Sprintf("A certificate for %s was just published on kindi.\n"+
+						"You can now send them encrypted files.\n", email),
+				})
+			}
+		}
+		done = append(done, keys[i])
+	}
+
+	err = deleteKeys(c, done)
+	if err != nil {
+		return err
+	}
+	// Returning the error retries the task for the webhooks that failed.
+	return lastErr
+}
+
+func (s *server) callWebhook(c appengine.Context, hook, email string) error {
+	body, err := json.Marshal(watchEvent{Event: "certificate_published", Email: email})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Transport: &urlfetch.Transport{
+			Context:  c,
+			Deadline: s.config.Watches.WebhookTimeout.Duration,
+		},
+	}
+	resp, err := client.Post(hook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}